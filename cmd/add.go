@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	addCodec        string
+	addReplication  int
+	addDataShards   int
+	addParityShards int
+	addLocalGroups  int
+	addEncrypt      string
+	addRecipient    string
+)
+
+var addCmd = &cobra.Command{
+	Use:   "add <file>",
+	Short: "Upload a file to the node",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// only send the flags that were set, the node fills in the rest
+		fields := map[string]string{}
+		if cmd.Flags().Changed("codec") {
+			fields["codec"] = addCodec
+		}
+		if cmd.Flags().Changed("replication") {
+			fields["replication"] = strconv.Itoa(addReplication)
+		}
+		if cmd.Flags().Changed("data-shards") {
+			fields["data_shards"] = strconv.Itoa(addDataShards)
+		}
+		if cmd.Flags().Changed("parity-shards") {
+			fields["parity_shards"] = strconv.Itoa(addParityShards)
+		}
+		if cmd.Flags().Changed("local-groups") {
+			fields["local_groups"] = strconv.Itoa(addLocalGroups)
+		}
+		if addEncrypt != "" {
+			fields["encryption"] = addEncrypt
+		}
+		if addRecipient != "" {
+			fields["recipient"] = addRecipient
+		}
+
+		// stream the form so large files never sit in memory
+		reader, writer := io.Pipe()
+		form := multipart.NewWriter(writer)
+		go func() {
+			writer.CloseWithError(writeUploadForm(form, file, fields))
+		}()
+
+		return apiRequest("POST", "/files/upload", reader, form.FormDataContentType())
+	},
+}
+
+func writeUploadForm(form *multipart.Writer, file *os.File, fields map[string]string) error {
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	part, err := form.CreateFormFile("file", filepath.Base(file.Name()))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("failed to read %s: %w", file.Name(), err)
+	}
+	return form.Close()
+}
+
+func init() {
+	addCmd.Flags().StringVar(&addCodec, "codec", "", "Codec: replication, reed-solomon or lrc")
+	addCmd.Flags().IntVar(&addReplication, "replication", 0, "Nodes that should store the file")
+	addCmd.Flags().IntVar(&addDataShards, "data-shards", 0, "Data shards")
+	addCmd.Flags().IntVar(&addParityShards, "parity-shards", 0, "Parity shards, or extra copies with the replication codec")
+	addCmd.Flags().IntVar(&addLocalGroups, "local-groups", 0, "Local parity groups of the lrc codec")
+	addCmd.Flags().StringVar(&addEncrypt, "encrypt", "", "Encrypt the file first: convergent or random")
+	addCmd.Flags().StringVar(&addRecipient, "recipient", "", "Wrap the file key for this recipient key instead of returning it, see key gen")
+
+	rootCmd.AddCommand(addCmd)
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"obscure-fs-rebuild/internal/encryption"
+
+	"github.com/spf13/cobra"
+)
+
+var identityPath string
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the identity encrypted files are shared with",
+}
+
+var keyGenCmd = &cobra.Command{
+	Use:   "gen",
+	Short: "Create an identity and print the recipient key uploads can wrap keys for",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identity, err := encryption.NewIdentity()
+		if err != nil {
+			return err
+		}
+
+		// O_EXCL so an existing identity, and every key wrapped for it, is
+		// never overwritten
+		file, err := os.OpenFile(identityPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := fmt.Fprintln(file, encryption.EncodeIdentity(identity)); err != nil {
+			return err
+		}
+
+		fmt.Println(encryption.EncodeRecipient(identity.PublicKey()))
+		return nil
+	},
+}
+
+var keyUnwrapCmd = &cobra.Command{
+	Use:   "unwrap <wrapped-key>",
+	Short: "Print the file key wrapped for this identity",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		raw, err := os.ReadFile(identityPath)
+		if err != nil {
+			return err
+		}
+
+		identity, err := encryption.ParseIdentity(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return err
+		}
+
+		key, err := encryption.UnwrapKey(args[0], identity)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(key)
+		return nil
+	},
+}
+
+func init() {
+	keyCmd.PersistentFlags().StringVar(&identityPath, "identity", "identity.key", "Path of the identity file")
+	keyCmd.AddCommand(keyGenCmd, keyUnwrapCmd)
+
+	rootCmd.AddCommand(keyCmd)
+}
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest <cid>",
+	Short: "Print a file manifest, fetching it from the network if needed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return apiRequest("GET", "/manifests/"+args[0], nil, "")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(manifestCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var directPin bool
+
+var pinCmd = &cobra.Command{
+	Use:   "pin",
+	Short: "Manage the content a node keeps through garbage collection",
+}
+
+var pinAddCmd = &cobra.Command{
+	Use:   "add <cid>",
+	Short: "Pin a file, fetching it first if the node doesn't have it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pinType := "recursive"
+		if directPin {
+			pinType = "direct"
+		}
+		return apiRequest("POST", fmt.Sprintf("/pins/%s?type=%s", args[0], pinType), nil, "")
+	},
+}
+
+var pinRmCmd = &cobra.Command{
+	Use:   "rm <cid>",
+	Short: "Remove a pin",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return apiRequest("DELETE", "/pins/"+args[0], nil, "")
+	},
+}
+
+var pinLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List pinned CIDs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return apiRequest("GET", "/pins/", nil, "")
+	},
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove everything the node doesn't store or pin",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return apiRequest("POST", "/gc", nil, "")
+	},
+}
+
+func init() {
+	pinAddCmd.Flags().BoolVar(&directPin, "direct", false, "Keep only the file's root and shards, not its blocks")
+
+	pinCmd.AddCommand(pinAddCmd, pinRmCmd, pinLsCmd)
+	rootCmd.AddCommand(pinCmd, gcCmd)
+}
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var rmCmd = &cobra.Command{
+	Use:   "rm <cid>",
+	Short: "Delete a file from the node, it has to be unpinned first",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return apiRequest("DELETE", "/files/"+args[0], nil, "")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+}
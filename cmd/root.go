@@ -12,14 +12,16 @@ import (
 )
 
 var (
-	rootCmd    = &cobra.Command{Use: "obscure-fs"}
+	rootCmd    = &cobra.Command{Use: "obscure-fs", SilenceUsage: true, SilenceErrors: true}
 	network    *networking.Network // Shared network instance
 	store      *storage.FileStore  // Shared storage instance
 	registry   *networking.NodeRegistry
 	ctx        = context.Background()
 	listenPort int
 	apiPort    int
+	apiKey     string
 	pkey       string
+	configPath string
 
 	bootstrapNodes = []string{
 		"/ip4/127.0.0.1/tcp/9090/p2p/QmR3nBwr1XLjpNqxTPhngV9auQGrsEjoWEdfC8UwKTX8bS",
@@ -35,11 +37,6 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.PersistentFlags().IntVar(&listenPort, "port", 0, "Port to listen on")
 	rootCmd.PersistentFlags().IntVar(&apiPort, "api-port", 8080, "Port for the REST API")
-	rootCmd.PersistentFlags().StringVar(&pkey, "pkey", "", "Private key path")
-
-	rootCmd.MarkPersistentFlagRequired("port")
-	rootCmd.MarkPersistentFlagRequired("api-port")
-	rootCmd.MarkPersistentFlagRequired("pkey")
+	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", "", "API key uploads are charged to")
 }
@@ -7,8 +7,11 @@ import (
 	"os/signal"
 
 	"obscure-fs-rebuild/internal/api"
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/config"
 	"obscure-fs-rebuild/internal/networking"
 	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
 	"obscure-fs-rebuild/utils"
 
 	"github.com/gin-gonic/gin"
@@ -21,9 +24,21 @@ var serveCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Println("Starting the node...")
 
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v\n", err)
+		}
+		err = codec.Validate(cfg.Erasure.Codec, cfg.Erasure.DataShards, cfg.Erasure.ParityShards, cfg.Erasure.LocalGroups)
+		if err != nil {
+			log.Fatalf("Invalid erasure config: %v\n", err)
+		}
+
 		if store == nil {
 			log.Println("Initializing file store...")
-			store = storage.NewFileStore()
+			store, err = storage.NewFileStore(internalutils.IndexPath, internalutils.BlocksPath, internalutils.PinsPath)
+			if err != nil {
+				log.Fatalf("Failed to open file store: %v\n", err)
+			}
 			log.Println("Sucessfully initialzied file store...")
 		}
 
@@ -37,8 +52,21 @@ var serveCmd = &cobra.Command{
 			log.Printf("Node ID: %s\n", network.GetHost().ID().String())
 			network.ConnectToBootstrapNodes()
 			network.AnnounceToPeers(network.GetHost().ID().String(), fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", listenPort))
+			network.SetShareDefaults(networking.ShareOptions{
+				Codec:  cfg.Erasure.Codec,
+				Shards: cfg.Erasure.DataShards,
+				Parity: cfg.Erasure.ParityShards,
+				Groups: cfg.Erasure.LocalGroups,
+			})
+			network.SetCapacity(cfg.Storage.Capacity)
+			network.StartReprovider(cfg.Reprovider)
+			network.StartReplicator(cfg.Replication)
+			network.StartScrubber(cfg.Scrub)
 		}
 
+		tempDir := fmt.Sprintf("%s/%s", internalutils.TempPath, network.GetHost().ID())
+		go store.RunGC(ctx, tempDir, cfg.Storage)
+
 		if registry == nil {
 			registry = networking.NewNodeRegistry()
 		}
@@ -48,12 +76,18 @@ var serveCmd = &cobra.Command{
 		router := gin.Default()
 		router.Use(func(c *gin.Context) {
 			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE, OPTIONS")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, If-None-Match, X-API-Key")
+			c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag")
 			c.Next()
 		})
 
-		nodeController := api.NewNodeController(ctx, store, registry, network)
+		quotas, err := storage.OpenQuotas(internalutils.QuotasPath, cfg.Storage)
+		if err != nil {
+			log.Fatalf("Failed to open quotas: %v\n", err)
+		}
+
+		nodeController := api.NewNodeController(ctx, store, registry, network, quotas)
 
 		nodes := router.Group("/nodes")
 		nodes.POST("/register", nodeController.RegisterNodeHandler)
@@ -63,6 +97,31 @@ var serveCmd = &cobra.Command{
 		files.GET("/", nodeController.GetFilesHandler)
 		files.POST("/upload", nodeController.FileUploadsHandler)
 		files.GET("/:cid", nodeController.GetFileHandler)
+		files.HEAD("/:cid", nodeController.GetFileHandler)
+		files.DELETE("/:cid", nodeController.DeleteFileHandler)
+
+		router.GET("/manifests/:cid", nodeController.GetManifestHandler)
+
+		stats := router.Group("/stats")
+		stats.GET("/dedupe", nodeController.GetDedupeStatsHandler)
+		stats.GET("/storage", nodeController.GetStorageStatsHandler)
+
+		pins := router.Group("/pins")
+		pins.GET("/", nodeController.GetPinsHandler)
+		pins.POST("/:cid", nodeController.PinHandler)
+		pins.DELETE("/:cid", nodeController.UnpinHandler)
+
+		router.POST("/gc", nodeController.GCHandler)
+
+		reprovider := router.Group("/reprovider")
+		reprovider.GET("/", nodeController.GetReproviderHandler)
+		reprovider.POST("/", nodeController.ReprovideHandler)
+
+		router.GET("/replication", nodeController.GetReplicationHandler)
+
+		scrub := router.Group("/scrub")
+		scrub.GET("/", nodeController.GetScrubReportHandler)
+		scrub.POST("/", nodeController.ScrubHandler)
 
 		go func() {
 			if err := router.Run(fmt.Sprintf(":%d", apiPort)); err != nil {
@@ -78,10 +137,20 @@ var serveCmd = &cobra.Command{
 		if err := network.Shutdown(); err != nil {
 			log.Printf("Failed to shut down network: %v", err)
 		}
+		if err := store.Close(); err != nil {
+			log.Printf("Failed to close file store: %v", err)
+		}
 		os.Exit(0)
 	},
 }
 
 func init() {
+	serveCmd.Flags().IntVar(&listenPort, "port", 0, "Port to listen on")
+	serveCmd.Flags().StringVar(&pkey, "pkey", "", "Private key path")
+	serveCmd.Flags().StringVar(&configPath, "config", "", "Path to a JSON config file")
+
+	serveCmd.MarkFlagRequired("port")
+	serveCmd.MarkFlagRequired("pkey")
+
 	rootCmd.AddCommand(serveCmd)
 }
@@ -1,18 +1,30 @@
 package api
 
 import (
-	"encoding/json"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 
-	"obscure-fs-rebuild/utils"
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/encryption"
+	"obscure-fs-rebuild/internal/networking"
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/internal/utils"
 
 	"github.com/gin-gonic/gin"
+	gocid "github.com/ipfs/go-cid"
 )
 
+// encryptionKeyHeader carries the key GetFileHandler decrypts with. A header
+// rather than a query parameter keeps it out of access logs.
+const encryptionKeyHeader = "X-Encryption-Key"
+
 func (nc *NodeController) FileUploadsHandler(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -20,40 +32,337 @@ func (nc *NodeController) FileUploadsHandler(c *gin.Context) {
 		return
 	}
 
-	uploadDir := "./uploads"
-	filePath := fmt.Sprintf("%s/%s", uploadDir, file.Filename)
+	opts, err := nc.shareOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// a key wrapped for a recipient is only useful on an encrypted file
+	var recipient *ecdh.PublicKey
+	if raw := c.PostForm("recipient"); raw != "" {
+		recipient, err = encryption.ParseRecipient(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if opts.Encryption == "" {
+			opts.Encryption = encryption.Random
+		}
+	}
+
+	// what ends up stored, and so what quota and capacity are checked for
+	size := file.Size
+	if opts.Encryption != "" {
+		size = encryption.CiphertextSize(size)
+	}
+
+	// clients that don't know the type send octet-stream, detection does
+	// better in that case
+	if contentType := file.Header.Get("Content-Type"); contentType != "application/octet-stream" {
+		opts.ContentType = contentType
+	}
+
+	// the quota is held until the upload is charged, so concurrent uploads
+	// can't overrun it together
+	key := c.GetHeader(apiKeyHeader)
+	if err := nc.quotas.Reserve(key, size); err != nil {
+		if errors.Is(err, storage.ErrUnknownKey) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown API key"})
+			return
+		}
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Quota exceeded"})
+		return
+	}
+	charged := false
+	defer func() {
+		if !charged {
+			nc.quotas.Cancel(key, size)
+		}
+	}()
+
+	stored := storage.EstimateStoredSize(size, opts.Shards, opts.Parity+opts.Groups)
+	if err := nc.reserveCapacity(stored); err != nil {
+		log.Printf("rejecting upload of %d bytes: %v\n", size, err)
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage"})
+		return
+	}
+	defer nc.releaseCapacity(stored)
+
+	// every upload gets its own directory so equal names never collide, the
+	// content itself is deduplicated by the blockstore
+	if err := os.MkdirAll(utils.TempPath, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	uploadDir, err := os.MkdirTemp(utils.TempPath, "upload-")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	defer os.RemoveAll(uploadDir)
+
+	filePath := fmt.Sprintf("%s/%s", uploadDir, filepath.Base(file.Filename))
 	if err := c.SaveUploadedFile(file, filePath); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
-	cid, err := nc.network.ShareFile(filePath)
+	cid, fileKey, err := nc.network.ShareFile(filePath, opts)
 	if err != nil {
+		log.Printf("failed to share file: %s, error: %v\n", filePath, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode file"})
 		return
 	}
 
+	charged = true
+	if err := nc.quotas.Commit(key, cid, size); err != nil {
+		log.Printf("failed to charge upload of %s: %v\n", cid, err)
+	}
+
+	response := gin.H{"message": "File uploaded successfully", "cid": cid}
+	if metadata, err := nc.metadata(cid); err == nil && metadata.Manifest != "" {
+		response["manifest"] = metadata.Manifest
+	}
+
+	// the key is only ever handed out here, the node doesn't keep it
+	switch {
+	case fileKey != nil && recipient != nil:
+		wrapped, err := encryption.WrapKey(fileKey, recipient)
+		if err != nil {
+			log.Printf("failed to wrap key of %s: %v\n", cid, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to wrap key"})
+			return
+		}
+		response["wrapped_key"] = wrapped
+	case fileKey != nil:
+		response["key"] = fileKey.String()
+	}
+
 	log.Printf("file uploaded: %s (CID: %s)\n", filePath, cid)
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "cid": cid})
+	c.JSON(http.StatusOK, response)
 }
 
 func (nc *NodeController) GetFileHandler(c *gin.Context) {
 	cid := c.Param("cid")
+	if _, err := gocid.Decode(cid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID"})
+		return
+	}
 
-	tempDir := fmt.Sprintf("./temp/%s", nc.network.GetHost().ID())
-	tempFilePath := fmt.Sprintf("%s/%s", tempDir, cid)
+	var fileKey encryption.Key
+	if raw := c.GetHeader(encryptionKeyHeader); raw != "" {
+		var err error
+		fileKey, err = encryption.ParseKey(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
+	tempFilePath, err := nc.cachePath(cid)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
 		return
 	}
 
-	err := nc.network.RetrieveFile(cid, tempFilePath)
+	if _, err := os.Stat(tempFilePath); err != nil {
+		err := nc.network.RetrieveFile(cid, tempFilePath)
+		if errors.Is(err, storage.ErrInsufficientStorage) {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+	}
+
+	file, err := os.Open(tempFilePath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+		return
+	}
+
+	// handles Range, If-Range, If-None-Match and HEAD, and sets
+	// Content-Length
+	if fileKey != nil {
+		// decrypted as it is sent, the plaintext never touches the disk.
+		// The stored type is hidden, so ServeContent sniffs it.
+		plain, err := encryption.NewReader(file, info.Size(), fileKey)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid key"})
+			return
+		}
+		setValidators(c, cid, true)
+		http.ServeContent(c.Writer, c.Request, cid, info.ModTime(), plain)
+		return
+	}
+
+	// ServeContent sniffs the content when no type is set
+	if contentType := nc.contentType(cid); contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+
+	setValidators(c, cid, false)
+	http.ServeContent(c.Writer, c.Request, cid, info.ModTime(), file)
+}
+
+// setValidators marks a response as cacheable. Content behind a CID never
+// changes, so the CID itself is a strong validator and clients may cache it
+// forever. Decrypted content must stay out of shared caches. Only content
+// that is actually served gets them, errors must not be cached.
+func setValidators(c *gin.Context, cid string, decrypted bool) {
+	c.Header("Vary", encryptionKeyHeader)
+	if decrypted {
+		c.Header("ETag", fmt.Sprintf("%q", cid+".decrypted"))
+		c.Header("Cache-Control", "private, max-age=31536000, immutable")
+		return
+	}
+
+	c.Header("ETag", fmt.Sprintf("%q", cid))
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// contentType returns the media type recorded for a locally stored file, or
+// in the manifest when cid is one.
+func (nc *NodeController) contentType(cid string) string {
+	if dag.IsJSON(cid) {
+		manifest, err := nc.store.GetManifest(cid)
+		if err != nil {
+			return ""
+		}
+		return manifest.ContentType
+	}
+
+	metadata, err := nc.metadata(cid)
+	if err != nil {
+		return ""
+	}
+	return metadata.ContentType
+}
+
+// metadata loads the metadata of a locally stored file.
+func (nc *NodeController) metadata(cid string) (*storage.Metadata, error) {
+	path, err := nc.store.GetFile(cid)
+	if err != nil {
+		return nil, err
+	}
+	return storage.LoadMetadata(path)
+}
+
+// shareOptions reads the optional codec, replication, data_shards,
+// parity_shards, local_groups and encryption form fields, filling in the
+// node's defaults. Picking another codec than the node's starts from that
+// codec's own layout.
+func (nc *NodeController) shareOptions(c *gin.Context) (networking.ShareOptions, error) {
+	opts := nc.network.ShareDefaults()
+	if id := c.PostForm("codec"); id != "" && id != opts.Codec {
+		selected, err := codec.Get(id)
+		if err != nil {
+			return opts, err
+		}
+		opts.Codec = selected.ID()
+		opts.Shards, opts.Parity, opts.Groups = selected.Layout()
+	}
+
+	fields := []struct {
+		name  string
+		value *int
+	}{
+		{"replication", &opts.Replication},
+		{"data_shards", &opts.Shards},
+		{"parity_shards", &opts.Parity},
+		{"local_groups", &opts.Groups},
+	}
+
+	for _, field := range fields {
+		raw, ok := c.GetPostForm(field.name)
+		if !ok || raw == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			return opts, fmt.Errorf("%s must be a non-negative number", field.name)
+		}
+		*field.value = value
+	}
+
+	if err := codec.Validate(opts.Codec, opts.Shards, opts.Parity, opts.Groups); err != nil {
+		return opts, err
+	}
+
+	opts.Encryption = c.PostForm("encryption")
+	if err := encryption.ValidateMode(opts.Encryption); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// DeleteFileHandler removes the node's copy of a file. The node stops
+// announcing it right away, provider records already in the DHT expire on
+// their own and peers asking for the file get a not-found in the meantime.
+func (nc *NodeController) DeleteFileHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	if _, err := gocid.Decode(cid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID"})
+		return
+	}
+
+	freed, err := nc.store.RemoveFile(cid)
+	found := err == nil
+	switch {
+	case errors.Is(err, storage.ErrPinned):
+		c.JSON(http.StatusConflict, gin.H{"error": "File is pinned"})
+		return
+	case err != nil && !errors.Is(err, storage.ErrFileNotFound):
+		log.Printf("failed to remove %s: %v\n", cid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+		return
+	}
+
+	cached := fmt.Sprintf("%s/%s", nc.tempDir(), cid)
+	if size, err := storage.GetFileSize(cached); err == nil {
+		if err := os.Remove(cached); err != nil {
+			log.Printf("failed to remove cached copy of %s: %v\n", cid, err)
+		}
+		freed += size
+		found = true
+	}
+
+	if !found {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
 
-	c.File(tempFilePath)
+	if err := nc.quotas.Release(cid); err != nil {
+		log.Printf("failed to release quota charges for %s: %v\n", cid, err)
+	}
+
+	log.Printf("file deleted: %s (%d bytes freed)\n", cid, freed)
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully", "cid": cid, "freed": freed})
+}
+
+// cachePath returns where a retrieved copy of cid is kept, creating the
+// node's temp directory if needed.
+func (nc *NodeController) cachePath(cid string) (string, error) {
+	tempDir := nc.tempDir()
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", tempDir, cid), nil
+}
+
+func (nc *NodeController) tempDir() string {
+	return fmt.Sprintf("%s/%s", utils.TempPath, nc.network.GetHost().ID())
 }
 
 func (n *NodeController) GetFilesHandler(c *gin.Context) {
@@ -71,29 +380,9 @@ func (n *NodeController) GetFilesHandler(c *gin.Context) {
 			continue
 		}
 
-		stream, err := n.network.GetHost().NewStream(n.ctx, peerID, utils.ProtocolID)
-		if err != nil {
-			log.Printf("Failed to create stream to peer %s: %v\n", peerID, err)
-			continue
-		}
-		defer stream.Close()
-
-		_, err = stream.Write([]byte("list_files")) // Protocol to list files
-		if err != nil {
-			log.Printf("Failed to request files from peer %s: %v\n", peerID, err)
-			continue
-		}
-
-		// Read response
-		peerFileData, err := io.ReadAll(stream)
+		peerFiles, err := n.network.ListPeerFiles(peerID)
 		if err != nil {
-			log.Printf("Failed to read files from peer %s: %v\n", peerID, err)
-			continue
-		}
-
-		var peerFiles map[string]string
-		if err := json.Unmarshal(peerFileData, &peerFiles); err != nil {
-			log.Printf("Failed to decode files from peer %s: %v\n", peerID, err)
+			log.Printf("Failed to list files from peer %s: %v\n", peerID, err)
 			continue
 		}
 
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"obscure-fs-rebuild/internal/dag"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (nc *NodeController) GetManifestHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	if !dag.IsJSON(cid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid manifest CID"})
+		return
+	}
+
+	manifest, err := nc.network.FetchManifest(cid)
+	if err != nil {
+		log.Printf("failed to fetch manifest %s: %v\n", cid, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Manifest not found"})
+		return
+	}
+
+	// like files, a manifest never changes under its CID
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.JSON(http.StatusOK, manifest)
+}
@@ -15,14 +15,16 @@ type NodeController struct {
 	store    *storage.FileStore
 	registry *networking.NodeRegistry
 	network  *networking.Network
+	quotas   *storage.Quotas
 }
 
-func NewNodeController(ctx context.Context, store *storage.FileStore, registry *networking.NodeRegistry, network *networking.Network) *NodeController {
+func NewNodeController(ctx context.Context, store *storage.FileStore, registry *networking.NodeRegistry, network *networking.Network, quotas *storage.Quotas) *NodeController {
 	return &NodeController{
 		ctx:      ctx,
 		store:    store,
 		registry: registry,
 		network:  network,
+		quotas:   quotas,
 	}
 }
 
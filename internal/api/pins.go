@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"obscure-fs-rebuild/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	gocid "github.com/ipfs/go-cid"
+)
+
+func (nc *NodeController) PinHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	if _, err := gocid.Decode(cid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID"})
+		return
+	}
+
+	pinType := storage.PinType(c.DefaultQuery("type", string(storage.PinRecursive)))
+	if pinType != storage.PinRecursive && pinType != storage.PinDirect {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pin type must be recursive or direct"})
+		return
+	}
+
+	// a recursive pin is only useful with the whole file at hand, so fetch it
+	// unless this node already stores it
+	if pinType == storage.PinRecursive {
+		if _, err := nc.store.GetFile(cid); err != nil {
+			tempFilePath, err := nc.cachePath(cid)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
+				return
+			}
+
+			if _, err := os.Stat(tempFilePath); err != nil {
+				err := nc.network.RetrieveFile(cid, tempFilePath)
+				if errors.Is(err, storage.ErrInsufficientStorage) {
+					c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Insufficient storage"})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+					return
+				}
+			}
+		}
+	}
+
+	if err := nc.store.Pins().Pin(cid, pinType); err != nil {
+		log.Printf("failed to pin %s: %v\n", cid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cid": cid, "type": pinType})
+}
+
+func (nc *NodeController) UnpinHandler(c *gin.Context) {
+	cid := c.Param("cid")
+
+	err := nc.store.Pins().Unpin(cid)
+	if errors.Is(err, storage.ErrNotPinned) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not pinned"})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to unpin %s: %v\n", cid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unpin"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cid": cid})
+}
+
+func (nc *NodeController) GetPinsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"pins": nc.store.Pins().List()})
+}
+
+func (nc *NodeController) GCHandler(c *gin.Context) {
+	result, err := nc.store.CollectGarbage(nc.tempDir())
+	if err != nil {
+		log.Printf("gc failed: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Garbage collection failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,11 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (nc *NodeController) GetReplicationHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, nc.network.ReplicationStatus())
+}
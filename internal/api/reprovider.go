@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (nc *NodeController) GetReproviderHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, nc.network.ReproviderStatus())
+}
+
+func (nc *NodeController) ReprovideHandler(c *gin.Context) {
+	if !nc.network.Reprovide() {
+		c.JSON(http.StatusConflict, gin.H{"error": "A run is already queued"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Reprovide started"})
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (nc *NodeController) GetScrubReportHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, nc.network.ScrubReport())
+}
+
+func (nc *NodeController) ScrubHandler(c *gin.Context) {
+	if !nc.network.Scrub() {
+		c.JSON(http.StatusConflict, gin.H{"error": "A scrub is already queued"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Scrub started"})
+}
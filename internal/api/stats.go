@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	"obscure-fs-rebuild/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploads are charged to the key sent in this header, or to the empty key
+const apiKeyHeader = "X-API-Key"
+
+func (nc *NodeController) GetDedupeStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, nc.store.Stats())
+}
+
+func (nc *NodeController) GetStorageStatsHandler(c *gin.Context) {
+	usage := nc.store.Usage(nc.tempDir())
+	usage.Capacity = nc.quotas.Capacity()
+
+	c.JSON(http.StatusOK, struct {
+		storage.StorageUsage
+		Quota storage.QuotaUsage `json:"quota"`
+	}{usage, nc.quotas.Usage(c.GetHeader(apiKeyHeader))})
+}
+
+// reserveCapacity holds size bytes of the node's capacity until
+// releaseCapacity, collecting garbage once before giving up.
+func (nc *NodeController) reserveCapacity(size int64) error {
+	return nc.store.ReserveCapacity(nc.quotas.Capacity(), size, nc.tempDir())
+}
+
+func (nc *NodeController) releaseCapacity(size int64) {
+	nc.store.ReleaseCapacity(size)
+}
@@ -0,0 +1,79 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+
+	"obscure-fs-rebuild/internal/storage"
+)
+
+const (
+	ReplicationID = "replication"
+	ReedSolomonID = "reed-solomon"
+	LRCID         = "lrc"
+)
+
+// Codec turns a file into shards and back. The ID of the codec is recorded
+// in the metadata, so a file is always decoded by the codec that encoded it.
+type Codec interface {
+	ID() string
+
+	// Layout returns the data shards, parity shards and local groups of
+	// uploads that pick the codec without a layout.
+	Layout() (shards, parity, groups int)
+	Validate(shards, parity, groups int) error
+
+	Encode(metadata *storage.Metadata, src io.Reader, size int64) error
+	// Decode writes the file the shards hold to outputPath, repairing
+	// damaged shards first.
+	Decode(metadata *storage.Metadata, outputPath string) error
+
+	// Repair rebuilds the missing or damaged shards in place and returns
+	// their indexes.
+	Repair(metadata *storage.Metadata) ([]int, error)
+
+	// RepairShards regenerates just the listed shards into their slots in
+	// metadata.Parts from the others, without decoding the file.
+	RepairShards(metadata *storage.Metadata, indexes []int) error
+}
+
+var registry = map[string]Codec{}
+
+func init() {
+	Register(ReplicationCodec{})
+	Register(ErasureCodec{})
+	Register(LRCCodec{})
+}
+
+// Register makes c available under its ID.
+func Register(c Codec) {
+	registry[c.ID()] = c
+}
+
+// Get returns the codec registered under id. An empty id is Reed-Solomon,
+// the only codec before the registry existed.
+func Get(id string) (Codec, error) {
+	if id == "" {
+		id = ReedSolomonID
+	}
+
+	c, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %q", id)
+	}
+	return c, nil
+}
+
+// For returns the codec that encoded metadata.
+func For(metadata *storage.Metadata) (Codec, error) {
+	return Get(metadata.Codec)
+}
+
+// Validate checks a layout against the codec registered under id.
+func Validate(id string, shards, parity, groups int) error {
+	c, err := Get(id)
+	if err != nil {
+		return err
+	}
+	return c.Validate(shards, parity, groups)
+}
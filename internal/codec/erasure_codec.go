@@ -1,44 +1,87 @@
 package codec
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 
+	"obscure-fs-rebuild/internal/hashing"
 	"obscure-fs-rebuild/internal/storage"
 	"obscure-fs-rebuild/internal/utils"
+	fileutils "obscure-fs-rebuild/utils"
 
 	"github.com/klauspost/reedsolomon"
 )
 
-type Codec interface {
-	Encode(metadata *storage.Metadata, src []byte) error
-	Decode(metadata *storage.Metadata) error
+// ErasureCodec is the Reed-Solomon codec, any Shards of the Shards+Pairty
+// shards rebuild the file.
+type ErasureCodec struct{}
+
+func (ErasureCodec) ID() string {
+	return ReedSolomonID
 }
 
-type ErasureCodec struct{}
+func (ErasureCodec) Layout() (shards, parity, groups int) {
+	return utils.Shards, utils.Pairty, 0
+}
 
-func (ErasureCodec) Encode(metadata *storage.Metadata, src []byte) (err error) {
-	log.Println("beginning encoding with default configs..")
-	log.Printf("shard size : %v\n", utils.Shards)
-	log.Printf("pairty size: %v\n", utils.Pairty)
+func (ErasureCodec) Validate(shards, parity, groups int) error {
+	if groups != 0 {
+		return errors.New("reed-solomon has no local groups")
+	}
+	return validateRS(shards, parity)
+}
 
-	if utils.Shards+utils.Pairty > 256 {
+// validateRS checks a data/parity layout against the limits of reedsolomon.
+// Layouts past 256 shards would switch reedsolomon to a different field, so
+// they are refused.
+func validateRS(shards, parity int) error {
+	if shards+parity > 256 {
 		return errors.New("sum of shard & pairty cannot be > 256")
 	}
+	if _, err := reedsolomon.New(shards, parity); err != nil {
+		return fmt.Errorf("invalid layout %d+%d: %w", shards, parity, err)
+	}
+	return nil
+}
 
-	enc, err := reedsolomon.New(utils.Shards, utils.Pairty)
-	if err != nil {
-		return
+// newStream returns the encoder for the layout of metadata. Shards are
+// processed ShardBlockSize bytes at a time, so memory stays bounded no
+// matter how large the file is.
+func newStream(metadata *storage.Metadata) (reedsolomon.StreamEncoder, error) {
+	return reedsolomon.NewStream(metadata.Shards, metadata.Pairty, reedsolomon.WithStreamBlockSize(utils.ShardBlockSize))
+}
+
+// Encode streams size bytes of src into metadata.Shards data and
+// metadata.Pairty parity shards, falling back to the default layout when
+// none is set.
+func (c ErasureCodec) Encode(metadata *storage.Metadata, src io.Reader, size int64) error {
+	metadata.Codec = c.ID()
+	if metadata.Shards == 0 {
+		metadata.Shards, metadata.Pairty, metadata.Groups = c.Layout()
 	}
 
-	shards, err := enc.Split(src)
+	err := c.Validate(metadata.Shards, metadata.Pairty, metadata.Groups)
 	if err != nil {
-		return
+		return err
 	}
+	return encodeRS(metadata, src, size)
+}
+
+// encodeRS writes the data and Reed-Solomon parity shards of src, filling in
+// the first Shards+Pairty entries of metadata.Parts and metadata.Hashes.
+func encodeRS(metadata *storage.Metadata, src io.Reader, size int64) (err error) {
+	metadata.Size = size
+
+	log.Println("beginning encoding..")
+	log.Printf("shard size : %v\n", metadata.Shards)
+	log.Printf("pairty size: %v\n", metadata.Pairty)
 
-	err = enc.Encode(shards)
+	enc, err := newStream(metadata)
 	if err != nil {
 		return
 	}
@@ -49,83 +92,456 @@ func (ErasureCodec) Encode(metadata *storage.Metadata, src []byte) (err error) {
 		return
 	}
 
-	metadata.Parts = make([]string, len(shards))
-	for i, shard := range shards {
-		shardFileName := fmt.Sprintf("%s/%s.%d", basePath, metadata.Checksum, i)
-
-		// updating metadata
-		metadata.Parts[i] = shardFileName
+	// Split rejects empty input, an empty file gets a zero byte per shard
+	if size == 0 {
+		src = bytes.NewReader(make([]byte, metadata.Shards))
+		size = int64(metadata.Shards)
+	}
 
-		_, err = os.Stat(shardFileName)
-		if err == nil {
-			log.Printf("chunk exists skipping: %s.%d\n", metadata.Checksum, i)
-			continue
+	writers := make([]*shardWriter, metadata.Shards+metadata.Pairty)
+	defer abortAll(writers)
+	for i := range writers {
+		writers[i], err = createShard(storage.ShardPath(metadata.Checksum, i))
+		if err != nil {
+			return
 		}
+	}
+
+	data := make([]io.Writer, metadata.Shards)
+	for i := range data {
+		data[i] = writers[i]
+	}
+	err = enc.Split(src, data, size)
+	if err != nil {
+		return
+	}
 
+	// parity is computed from the data shards just written
+	written := make([]io.Reader, metadata.Shards)
+	for i := range written {
+		written[i] = writers[i].reader()
+	}
+	parity := make([]io.Writer, metadata.Pairty)
+	for i := range parity {
+		parity[i] = writers[metadata.Shards+i]
+	}
+	err = enc.Encode(written, parity)
+	if err != nil {
+		return
+	}
+
+	metadata.Parts = make([]string, len(writers))
+	metadata.Hashes = make([]string, len(writers))
+	for i, w := range writers {
 		log.Printf("saving chunk: %s.%d\n", metadata.Checksum, i)
 
-		err = os.WriteFile(shardFileName, shard, 0644)
+		// updating metadata
+		metadata.Parts[i] = w.path
+		metadata.Hashes[i], err = w.commit("")
 		if err != nil {
 			return
 		}
 	}
 
-	// updating metadata
-	metadata.Shards = utils.Shards
-	metadata.Pairty = utils.Pairty
-
 	return
 }
 
-func (ErasureCodec) Decode(metadata *storage.Metadata) (outfile string, err error) {
-	log.Println("beginning decoding with default configs..")
+func (ErasureCodec) Decode(metadata *storage.Metadata, outputPath string) (err error) {
+	log.Println("beginning decoding..")
 	log.Printf("shard size : %v\n", metadata.Shards)
 	log.Printf("pairty size: %v\n", metadata.Pairty)
 
-	enc, _ := reedsolomon.New(metadata.Shards, metadata.Pairty)
+	enc, err := newStream(metadata)
+	if err != nil {
+		return
+	}
+
+	// shards that fail their hash are treated as erasures, so parity goes
+	// exactly where it is needed
+	damaged := checkShards(metadata)
+	if len(metadata.Hashes) == len(metadata.Parts) {
+		if len(damaged) > 0 {
+			log.Printf("reconstructing %d shards of %s...\n", len(damaged), metadata.Checksum)
+			err = rebuildShards(metadata, damaged, nil)
+			if err != nil {
+				log.Println("failed to reconstruct!", err)
+				return
+			}
+		}
+	} else {
+		// metadata written before shard hashes were recorded
+		ok, _ := verifyShards(enc, metadata, nil)
+		if !ok {
+			log.Printf("unable to verify shard %s, trying to reconstruct...", metadata.Checksum)
+			err = reconstruct(enc, metadata, damaged)
+			if err != nil {
+				log.Println("failed to reconstruct!", err)
+				return
+			}
+		}
+	}
+	log.Println("reconstruction success!!!", metadata.Checksum)
+
+	return joinShards(enc, metadata, outputPath)
+}
+
+// joinShards writes the file held by the data shards to outputPath.
+func joinShards(enc reedsolomon.StreamEncoder, metadata *storage.Metadata, outputPath string) (err error) {
+	shards, closeShards, err := openShards(metadata, nil)
+	if err != nil {
+		return
+	}
+	defer closeShards()
+
+	// Join stops at the original size, dropping the padding Split added.
+	// Readers of the decoded copy never see it half written.
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(enc.Join(writer, shards, metadata.Size))
+	}()
+	defer reader.Close()
+
+	err = fileutils.WriteFileAtomic(outputPath, reader, metadata.Size)
+	if err != nil {
+		return
+	}
+
+	log.Printf("file decoded & saved sucessfully : %s\n", outputPath)
+
+	return nil
+}
+
+// Repair re-hashes every shard against metadata.Hashes and rebuilds the
+// missing or damaged ones from the others, returning the indexes of the
+// shards it found damaged.
+func (ErasureCodec) Repair(metadata *storage.Metadata) (damaged []int, err error) {
+	damaged = checkShards(metadata)
+	if len(damaged) == 0 {
+		return
+	}
+
+	err = rebuildShards(metadata, damaged, nil)
+	return
+}
+
+// RepairShards regenerates the listed shards from Shards of the others. The
+// other shards are trusted at first; when a result fails its hash they are
+// all checked and the damaged ones left out.
+func (ErasureCodec) RepairShards(metadata *storage.Metadata, indexes []int) error {
+	err := rebuildShards(metadata, indexes, nil)
+	if errors.Is(err, hashing.ErrHashMismatch) {
+		log.Printf("regenerated shard of %s is damaged, checking its sources\n", metadata.Checksum)
+		err = rebuildShards(metadata, indexes, checkShards(metadata))
+	}
+	return err
+}
+
+// checkShards reports the shards of a file that are missing, have the wrong
+// size or don't match their hash.
+func checkShards(metadata *storage.Metadata) (damaged []int) {
+	shardSize := int64(metadata.GetShardSize())
+	for i, part := range metadata.Parts {
+		size, err := storage.GetFileSize(part)
+		if err == nil && size != shardSize {
+			err = fmt.Errorf("shard has %d bytes, expected %d", size, shardSize)
+		}
+		if err == nil && i < len(metadata.Hashes) {
+			err = hashing.VerifyBlock(part, metadata.Hashes[i])
+		}
+
+		if err != nil {
+			log.Printf("damaged shard %s.%d: %v\n", metadata.Checksum, i, err)
+			damaged = append(damaged, i)
+		}
+	}
+	return
+}
 
-	shards := make([][]byte, metadata.GetShardSum())
+// openShards opens every shard of a file for reading. Shards listed in skip
+// are left nil.
+func openShards(metadata *storage.Metadata, skip []int) (shards []io.Reader, closeAll func(), err error) {
+	var files []*os.File
+	closeAll = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	shards = make([]io.Reader, len(metadata.Parts))
 	for i, part := range metadata.Parts {
-		fmt.Printf("part: %v\n", part)
-		shards[i], err = os.ReadFile(part)
+		if contains(skip, i) {
+			continue
+		}
+
+		f, err := os.Open(part)
 		if err != nil {
-			log.Printf("malformed shard: %s.%d\n", metadata.Checksum, i)
+			closeAll()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		shards[i] = f
+	}
+	return shards, closeAll, nil
+}
+
+// reconstructSome recomputes just the listed shards into temp files, which
+// the caller commits or aborts. It reads Shards of the other shards, data
+// shards first and none of those in skip, a block at a time, so neither the
+// file nor whole shards are ever held in memory.
+func reconstructSome(metadata *storage.Metadata, indexes, skip []int) (writers []*shardWriter, err error) {
+	enc, err := reedsolomon.New(metadata.Shards, metadata.Pairty)
+	if err != nil {
+		return
+	}
+
+	total := metadata.Shards + metadata.Pairty
+	shardSize := metadata.GetShardSize()
+
+	sources := make(map[int]*os.File)
+	defer func() {
+		for _, f := range sources {
+			f.Close()
+		}
+	}()
+	for i := 0; i < total && len(sources) < metadata.Shards; i++ {
+		if contains(indexes, i) || contains(skip, i) {
+			continue
+		}
+		if size, err := storage.GetFileSize(metadata.Parts[i]); err != nil || size != int64(shardSize) {
+			continue
+		}
+
+		f, err := os.Open(metadata.Parts[i])
+		if err != nil {
+			continue
+		}
+		sources[i] = f
+	}
+	if len(sources) < metadata.Shards {
+		return nil, fmt.Errorf("%w: %d of %d needed", reedsolomon.ErrTooFewShards, len(sources), metadata.Shards)
+	}
+
+	required := make([]bool, total)
+	buffers := make([][]byte, total)
+	for _, i := range indexes {
+		w, err := createShard(metadata.Parts[i])
+		if err != nil {
+			abortAll(writers)
+			return nil, err
+		}
+		writers = append(writers, w)
+		required[i] = true
+		buffers[i] = make([]byte, utils.ShardBlockSize)
+	}
+	for i := range sources {
+		buffers[i] = make([]byte, utils.ShardBlockSize)
+	}
+
+	shards := make([][]byte, total)
+	for offset := 0; offset < shardSize; {
+		n := min(utils.ShardBlockSize, shardSize-offset)
+		for i := range shards {
 			shards[i] = nil
+			if required[i] {
+				// empty with capacity, ReconstructSome fills it in place
+				shards[i] = buffers[i][:0]
+			}
+		}
+		for i, f := range sources {
+			shards[i] = buffers[i][:n]
+			if _, err = io.ReadFull(f, shards[i]); err != nil {
+				abortAll(writers)
+				return nil, err
+			}
+		}
+
+		err = enc.ReconstructSome(shards, required)
+		if err != nil {
+			abortAll(writers)
+			return nil, err
 		}
+
+		for k, i := range indexes {
+			if _, err = writers[k].Write(shards[i][:n]); err != nil {
+				abortAll(writers)
+				return nil, err
+			}
+		}
+		offset += n
 	}
+	return writers, nil
+}
 
-	// verify
-	ok, _ := enc.Verify(shards)
-	if ok {
-		log.Println("reconstruction success!!!", metadata.Checksum)
-	} else {
+// rebuildShards regenerates the listed shards without using those in skip,
+// checking each against its hash before it replaces anything on disk.
+func rebuildShards(metadata *storage.Metadata, indexes, skip []int) error {
+	writers, err := reconstructSome(metadata, indexes, skip)
+	if err != nil {
+		return err
+	}
+	defer abortAll(writers)
 
-		// retry block
-		log.Printf("unable to verify shard %s, trying to reconstruct...", metadata.Checksum)
-		err = enc.Reconstruct(shards)
+	for n, i := range indexes {
+		var expected string
+		if i < len(metadata.Hashes) {
+			expected = metadata.Hashes[i]
+		}
+
+		_, err := writers[n].commit(expected)
 		if err != nil {
-			log.Println("failed to reconstruct!", err)
-			return
+			return fmt.Errorf("reconstructed shard %s.%d: %w", metadata.Checksum, i, err)
 		}
+		log.Printf("rewrote shard %s.%d\n", metadata.Checksum, i)
+	}
+	return nil
+}
 
-		ok, _ = enc.Verify(shards)
+// verifyShards checks the parity of a file, reading the shards in override
+// instead of the ones on disk.
+func verifyShards(enc reedsolomon.StreamEncoder, metadata *storage.Metadata, override map[int]io.Reader) (bool, error) {
+	var skip []int
+	for i := range override {
+		skip = append(skip, i)
+	}
+
+	shards, closeShards, err := openShards(metadata, skip)
+	if err != nil {
+		return false, err
+	}
+	defer closeShards()
+
+	for i, r := range override {
+		shards[i] = r
+	}
+	return enc.Verify(shards)
+}
+
+// reconstruct fills in missing shards of files without shard hashes. Shards
+// that are present but corrupted can't be told apart, so when the set still
+// fails to verify each shard is regenerated in turn and kept only if that
+// makes the set verify.
+func reconstruct(enc reedsolomon.StreamEncoder, metadata *storage.Metadata, missing []int) error {
+	if len(missing) > 0 {
+		err := rebuildShards(metadata, missing, nil)
+		if err != nil {
+			return err
+		}
+
+		ok, _ := verifyShards(enc, metadata, nil)
 		if ok {
-			log.Println("reconstruction success!!!", metadata.Checksum)
+			return nil
 		}
 	}
 
-	outfile = fmt.Sprintf("%s/%s/%s", utils.StoragePath, metadata.Checksum, metadata.Name)
-	f, err := os.Create(outfile)
+	for i := range metadata.Parts {
+		writers, err := reconstructSome(metadata, []int{i}, nil)
+		if err != nil {
+			continue
+		}
+
+		ok, _ := verifyShards(enc, metadata, map[int]io.Reader{i: writers[0].reader()})
+		if !ok {
+			writers[0].abort()
+			continue
+		}
+
+		log.Printf("shard %d is corrupted, recovered from parity\n", i)
+		_, err = writers[0].commit("")
+		return err
+	}
+
+	return errors.New("shards are corrupted beyond repair")
+}
+
+// shardWriter writes a shard into a temp file next to its final path,
+// hashing it on the way. commit renames it into place.
+type shardWriter struct {
+	path   string
+	file   *os.File
+	hasher *hashing.Hasher
+	size   int64
+	done   bool
+}
+
+func createShard(path string) (*shardWriter, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &shardWriter{path: path, file: file, hasher: hashing.BlockHasherFor("")}, nil
+}
+
+func (w *shardWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// reader reads back what has been written so far.
+func (w *shardWriter) reader() io.Reader {
+	return io.NewSectionReader(w.file, 0, w.size)
+}
+
+// commit moves the shard into place and returns its hash. When expected is
+// set a shard with a different hash is discarded instead.
+func (w *shardWriter) commit(expected string) (sum string, err error) {
+	defer w.abort()
+
+	if expected != "" {
+		err = w.hasher.Verify(expected)
+		if err != nil {
+			return
+		}
+	}
+
+	sum, err = w.hasher.CID()
+	if err != nil {
+		return
+	}
+
+	err = w.file.Sync()
+	if err != nil {
+		return
+	}
+
+	err = w.file.Chmod(0644)
 	if err != nil {
 		return
 	}
 
-	err = enc.Join(f, shards, len(shards[0])*utils.Shards)
+	err = os.Rename(w.file.Name(), w.path)
 	if err != nil {
 		return
 	}
 
-	log.Printf("file decoded & saved sucessfully : %s\n", outfile)
+	w.done = true
+	return sum, nil
+}
+
+// abort drops the temp file unless the shard was committed.
+func (w *shardWriter) abort() {
+	w.file.Close()
+	if !w.done {
+		os.Remove(w.file.Name())
+	}
+	w.done = true
+}
 
-	return outfile, nil
+func abortAll(writers []*shardWriter) {
+	for _, w := range writers {
+		if w != nil {
+			w.abort()
+		}
+	}
+}
+
+func contains(indexes []int, i int) bool {
+	for _, index := range indexes {
+		if index == i {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,260 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/internal/utils"
+)
+
+// LRCCodec is a locally repairable code: Reed-Solomon over Shards data and
+// Pairty global parity shards, followed by one XOR parity per group of data
+// shards. A group that lost a single shard is rebuilt from the rest of the
+// group, reading about Shards/Groups shards instead of Shards.
+type LRCCodec struct{}
+
+func (LRCCodec) ID() string {
+	return LRCID
+}
+
+func (LRCCodec) Layout() (shards, parity, groups int) {
+	return utils.Shards, utils.Pairty, utils.LocalGroups
+}
+
+func (LRCCodec) Validate(shards, parity, groups int) error {
+	if groups < 1 || groups > shards {
+		return fmt.Errorf("lrc needs between 1 and %d local groups", shards)
+	}
+	if shards+parity+groups > 256 {
+		return errors.New("sum of shard, pairty & groups cannot be > 256")
+	}
+	return validateRS(shards, parity)
+}
+
+func (c LRCCodec) Encode(metadata *storage.Metadata, src io.Reader, size int64) (err error) {
+	metadata.Codec = c.ID()
+	if metadata.Shards == 0 {
+		metadata.Shards, metadata.Pairty, metadata.Groups = c.Layout()
+	}
+
+	err = c.Validate(metadata.Shards, metadata.Pairty, metadata.Groups)
+	if err != nil {
+		return
+	}
+
+	err = encodeRS(metadata, src, size)
+	if err != nil {
+		return
+	}
+
+	for j := 0; j < metadata.Groups; j++ {
+		i := localParity(metadata, j)
+		log.Printf("saving local parity: %s.%d\n", metadata.Checksum, i)
+
+		path := storage.ShardPath(metadata.Checksum, i)
+		hash, err := writeXOR(metadata, groupMembers(metadata, j), path, "")
+		if err != nil {
+			return err
+		}
+		metadata.Parts = append(metadata.Parts, path)
+		metadata.Hashes = append(metadata.Hashes, hash)
+	}
+	return
+}
+
+func (c LRCCodec) Decode(metadata *storage.Metadata, outputPath string) (err error) {
+	log.Println("beginning decoding..")
+
+	_, err = c.Repair(metadata)
+	if err != nil {
+		log.Println("failed to reconstruct!", err)
+		return
+	}
+
+	enc, err := newStream(metadata)
+	if err != nil {
+		return
+	}
+	return joinShards(enc, rsView(metadata), outputPath)
+}
+
+// Repair checks every shard and rebuilds the missing or damaged ones.
+func (LRCCodec) Repair(metadata *storage.Metadata) (damaged []int, err error) {
+	damaged = checkShards(metadata)
+	if len(damaged) == 0 {
+		return
+	}
+
+	err = repairLRC(metadata, damaged, damaged)
+	return
+}
+
+// RepairShards regenerates just the listed shards, from their local group
+// when it is otherwise whole. The other shards are trusted at first; when a
+// result fails its hash they are all checked and the damaged ones left out.
+func (LRCCodec) RepairShards(metadata *storage.Metadata, indexes []int) error {
+	err := repairLRC(metadata, indexes, nil)
+	if errors.Is(err, hashing.ErrHashMismatch) {
+		log.Printf("regenerated shard of %s is damaged, checking its sources\n", metadata.Checksum)
+		err = repairLRC(metadata, indexes, checkShards(metadata))
+	}
+	return err
+}
+
+// repairLRC rebuilds the shards in indexes without reading those in bad. A
+// group missing a single shard is rebuilt from the rest of the group and
+// anything else is left to the global parity. Local parities are recomputed
+// last, once the data they cover is whole.
+func repairLRC(metadata *storage.Metadata, indexes, bad []int) error {
+	unavailable := func(i int) bool {
+		return contains(indexes, i) || contains(bad, i)
+	}
+
+	repaired := map[int]bool{}
+	for j := 0; j < metadata.Groups; j++ {
+		group := append(groupMembers(metadata, j), localParity(metadata, j))
+
+		var lost, sources []int
+		for _, i := range group {
+			if unavailable(i) {
+				lost = append(lost, i)
+			} else {
+				sources = append(sources, i)
+			}
+		}
+		if len(lost) != 1 || !contains(indexes, lost[0]) {
+			continue
+		}
+
+		_, err := writeXOR(metadata, sources, metadata.Parts[lost[0]], expectedHash(metadata, lost[0]))
+		if err != nil {
+			log.Printf("failed to rebuild shard %s.%d from its local group: %v\n", metadata.Checksum, lost[0], err)
+			continue
+		}
+		log.Printf("rebuilt shard %s.%d from its local group\n", metadata.Checksum, lost[0])
+		repaired[lost[0]] = true
+	}
+
+	var global, skip []int
+	for i := 0; i < metadata.Shards+metadata.Pairty; i++ {
+		switch {
+		case repaired[i]:
+		case contains(indexes, i):
+			global = append(global, i)
+		case contains(bad, i):
+			skip = append(skip, i)
+		}
+	}
+	if len(global) > 0 {
+		log.Printf("reconstructing %d shards of %s...\n", len(global), metadata.Checksum)
+		err := rebuildShards(rsView(metadata), global, skip)
+		if err != nil {
+			return err
+		}
+	}
+
+	for j := 0; j < metadata.Groups; j++ {
+		i := localParity(metadata, j)
+		if !contains(indexes, i) || repaired[i] {
+			continue
+		}
+
+		_, err := writeXOR(metadata, groupMembers(metadata, j), metadata.Parts[i], expectedHash(metadata, i))
+		if err != nil {
+			return fmt.Errorf("local parity %s.%d: %w", metadata.Checksum, i, err)
+		}
+		log.Printf("rewrote shard %s.%d\n", metadata.Checksum, i)
+	}
+	return nil
+}
+
+// groupMembers returns the data shards of local group j. Groups split the
+// data shards into contiguous runs that differ in size by at most one.
+func groupMembers(metadata *storage.Metadata, j int) []int {
+	start := j * metadata.Shards / metadata.Groups
+	end := (j + 1) * metadata.Shards / metadata.Groups
+
+	members := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		members = append(members, i)
+	}
+	return members
+}
+
+// localParity returns the shard index of the XOR parity of group j.
+func localParity(metadata *storage.Metadata, j int) int {
+	return metadata.Shards + metadata.Pairty + j
+}
+
+// rsView is metadata limited to its Reed-Solomon shards.
+func rsView(metadata *storage.Metadata) *storage.Metadata {
+	n := metadata.Shards + metadata.Pairty
+
+	view := *metadata
+	view.Groups = 0
+	view.Parts = metadata.Parts[:n]
+	if len(view.Hashes) > n {
+		view.Hashes = metadata.Hashes[:n]
+	}
+	return &view
+}
+
+func expectedHash(metadata *storage.Metadata, i int) string {
+	if i < len(metadata.Hashes) {
+		return metadata.Hashes[i]
+	}
+	return ""
+}
+
+// writeXOR writes the XOR of the sources shards to path, a block at a time,
+// and returns its hash. When expected is set a result with a different hash
+// is discarded.
+func writeXOR(metadata *storage.Metadata, sources []int, path, expected string) (string, error) {
+	files := make([]*os.File, 0, len(sources))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, i := range sources {
+		f, err := os.Open(metadata.Parts[i])
+		if err != nil {
+			return "", err
+		}
+		files = append(files, f)
+	}
+
+	w, err := createShard(path)
+	if err != nil {
+		return "", err
+	}
+	defer w.abort()
+
+	sum := make([]byte, utils.ShardBlockSize)
+	buf := make([]byte, utils.ShardBlockSize)
+	for remaining := metadata.GetShardSize(); remaining > 0; {
+		n := min(remaining, len(sum))
+
+		clear(sum[:n])
+		for _, f := range files {
+			if _, err := io.ReadFull(f, buf[:n]); err != nil {
+				return "", err
+			}
+			for k := range n {
+				sum[k] ^= buf[k]
+			}
+		}
+
+		if _, err := w.Write(sum[:n]); err != nil {
+			return "", err
+		}
+		remaining -= n
+	}
+
+	return w.commit(expected)
+}
@@ -0,0 +1,192 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/internal/utils"
+	fileutils "obscure-fs-rebuild/utils"
+)
+
+// ReplicationCodec stores 1+Pairty whole copies of the file as its shards,
+// any one of them is enough to rebuild the others.
+type ReplicationCodec struct{}
+
+func (ReplicationCodec) ID() string {
+	return ReplicationID
+}
+
+func (ReplicationCodec) Layout() (shards, parity, groups int) {
+	return 1, utils.Pairty, 0
+}
+
+func (ReplicationCodec) Validate(shards, parity, groups int) error {
+	if shards != 1 {
+		return errors.New("replication stores whole copies, data shards must be 1")
+	}
+	if parity < 0 || groups != 0 {
+		return fmt.Errorf("invalid replication layout %d+%d", shards, parity)
+	}
+	if shards+parity > 256 {
+		return errors.New("replication cannot keep more than 256 copies")
+	}
+	return nil
+}
+
+func (c ReplicationCodec) Encode(metadata *storage.Metadata, src io.Reader, size int64) (err error) {
+	metadata.Codec = c.ID()
+	if metadata.Shards == 0 {
+		metadata.Shards, metadata.Pairty, metadata.Groups = c.Layout()
+	}
+	metadata.Size = size
+
+	err = c.Validate(metadata.Shards, metadata.Pairty, metadata.Groups)
+	if err != nil {
+		return
+	}
+
+	log.Printf("replicating %s into %d copies..\n", metadata.Checksum, metadata.GetShardSum())
+
+	err = os.MkdirAll(fmt.Sprintf("%s/%s", utils.StoragePath, metadata.Checksum), 0755)
+	if err != nil {
+		return
+	}
+
+	writers := make([]*shardWriter, metadata.GetShardSum())
+	defer abortAll(writers)
+	copies := make([]io.Writer, len(writers))
+	for i := range writers {
+		writers[i], err = createShard(storage.ShardPath(metadata.Checksum, i))
+		if err != nil {
+			return
+		}
+		copies[i] = writers[i]
+	}
+
+	// every copy is written in the same pass over src
+	_, err = io.CopyN(io.MultiWriter(copies...), src, size)
+	if err != nil {
+		return
+	}
+
+	// like the other codecs, an empty file still gets a byte per shard
+	if size == 0 {
+		_, err = io.MultiWriter(copies...).Write([]byte{0})
+		if err != nil {
+			return
+		}
+	}
+
+	metadata.Parts = make([]string, len(writers))
+	metadata.Hashes = make([]string, len(writers))
+	for i, w := range writers {
+		metadata.Parts[i] = w.path
+		metadata.Hashes[i], err = w.commit("")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c ReplicationCodec) Decode(metadata *storage.Metadata, outputPath string) (err error) {
+	_, err = c.Repair(metadata)
+	if err != nil {
+		return
+	}
+
+	src, err := os.Open(metadata.Parts[0])
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	err = fileutils.WriteFileAtomic(outputPath, src, metadata.Size)
+	if err != nil {
+		return
+	}
+
+	log.Printf("file decoded & saved sucessfully : %s\n", outputPath)
+	return nil
+}
+
+// Repair overwrites damaged copies with the first intact one.
+func (ReplicationCodec) Repair(metadata *storage.Metadata) (damaged []int, err error) {
+	damaged = checkShards(metadata)
+	if len(damaged) == 0 {
+		return
+	}
+
+	source := -1
+	for i := range metadata.Parts {
+		if !contains(damaged, i) {
+			source = i
+			break
+		}
+	}
+	if source < 0 {
+		return damaged, errors.New("no intact copy left")
+	}
+
+	for _, i := range damaged {
+		err = copyShard(metadata, source, i)
+		if err != nil {
+			return
+		}
+		log.Printf("rewrote shard %s.%d\n", metadata.Checksum, i)
+	}
+	return
+}
+
+// RepairShards copies an intact copy over the listed ones, trying each of
+// the other copies until one hashes right.
+func (ReplicationCodec) RepairShards(metadata *storage.Metadata, indexes []int) error {
+	for _, i := range indexes {
+		err := errors.New("no intact copy left")
+		for source := range metadata.Parts {
+			if contains(indexes, source) {
+				continue
+			}
+
+			err = copyShard(metadata, source, i)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("shard %s.%d: %w", metadata.Checksum, i, err)
+		}
+		log.Printf("rewrote shard %s.%d\n", metadata.Checksum, i)
+	}
+	return nil
+}
+
+// copyShard replaces shard to with the content of shard from.
+func copyShard(metadata *storage.Metadata, from, to int) error {
+	src, err := os.Open(metadata.Parts[from])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w, err := createShard(metadata.Parts[to])
+	if err != nil {
+		return err
+	}
+	defer w.abort()
+
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+
+	var expected string
+	if to < len(metadata.Hashes) {
+		expected = metadata.Hashes[to]
+	}
+	_, err = w.commit(expected)
+	return err
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"obscure-fs-rebuild/internal/utils"
+)
+
+// Config holds the node settings that can be changed without rebuilding. A
+// missing config file leaves every setting at its default.
+type Config struct {
+	Storage     StorageConfig     `json:"storage"`
+	Reprovider  ReproviderConfig  `json:"reprovider"`
+	Replication ReplicationConfig `json:"replication"`
+	Scrub       ScrubConfig       `json:"scrub"`
+	Erasure     ErasureConfig     `json:"erasure"`
+}
+
+type StorageConfig struct {
+	// bytes the node may use for uploads, shards, blocks and cached files,
+	// zero means unlimited
+	Capacity int64 `json:"capacity"`
+	// fraction of Capacity above which garbage collection kicks in
+	GCWatermark float64  `json:"gc_watermark"`
+	GCInterval  Duration `json:"gc_interval"`
+	// bytes each API key may upload, zero means unlimited. Once any key is
+	// listed, uploads with other keys or none are refused; DefaultQuota only
+	// applies while no key is listed
+	Quotas       map[string]int64 `json:"quotas"`
+	DefaultQuota int64            `json:"default_quota"`
+}
+
+type ReproviderConfig struct {
+	// "all" announces stored, pinned and hosted CIDs, "pinned" leaves out
+	// hosted shards and "roots" announces only files stored on this node
+	Strategy string   `json:"strategy"`
+	Interval Duration `json:"interval"`
+	// announcements per second
+	RateLimit int `json:"rate_limit"`
+}
+
+type ReplicationConfig struct {
+	// nodes that should store each file unless its upload asked otherwise
+	Factor   int      `json:"factor"`
+	Interval Duration `json:"interval"`
+}
+
+type ScrubConfig struct {
+	Interval Duration `json:"interval"`
+}
+
+// ErasureConfig is the codec and layout of uploads that don't ask for one.
+// The codec checks the layout when the node starts.
+type ErasureConfig struct {
+	Codec        string `json:"codec"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+
+	// only used by lrc
+	LocalGroups int `json:"local_groups"`
+}
+
+// Duration reads durations written as strings such as "10m" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		Storage: StorageConfig{
+			GCWatermark: 0.9,
+			GCInterval:  Duration{10 * time.Minute},
+		},
+		Reprovider: ReproviderConfig{
+			Strategy:  "all",
+			Interval:  Duration{12 * time.Hour},
+			RateLimit: 5,
+		},
+		Replication: ReplicationConfig{
+			Factor:   3,
+			Interval: Duration{30 * time.Minute},
+		},
+		Scrub: ScrubConfig{
+			Interval: Duration{24 * time.Hour},
+		},
+		Erasure: ErasureConfig{
+			Codec:        "reed-solomon",
+			DataShards:   utils.Shards,
+			ParityShards: utils.Pairty,
+		},
+	}
+}
+
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("malformed config %s: %w", path, err)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) Validate() error {
+	if c.Storage.Capacity < 0 {
+		return fmt.Errorf("storage capacity must not be negative")
+	}
+	if c.Storage.DefaultQuota < 0 {
+		return fmt.Errorf("default quota must not be negative")
+	}
+	for key, quota := range c.Storage.Quotas {
+		if quota < 0 {
+			return fmt.Errorf("quota for key %q must not be negative", key)
+		}
+	}
+	if c.Storage.GCWatermark <= 0 || c.Storage.GCWatermark > 1 {
+		return fmt.Errorf("gc watermark must be in (0, 1], got %v", c.Storage.GCWatermark)
+	}
+	if c.Storage.GCInterval.Duration <= 0 {
+		return fmt.Errorf("gc interval must be positive")
+	}
+	switch c.Reprovider.Strategy {
+	case "all", "pinned", "roots":
+	default:
+		return fmt.Errorf("unknown reprovider strategy: %q", c.Reprovider.Strategy)
+	}
+	if c.Reprovider.Interval.Duration <= 0 {
+		return fmt.Errorf("reprovider interval must be positive")
+	}
+	// the reprovider waits time.Second / rate_limit between CIDs, which
+	// must not round down to zero
+	if c.Reprovider.RateLimit <= 0 || c.Reprovider.RateLimit > int(time.Second) {
+		return fmt.Errorf("reprovider rate limit must be between 1 and %d, got %d", int(time.Second), c.Reprovider.RateLimit)
+	}
+	if c.Replication.Factor <= 0 {
+		return fmt.Errorf("replication factor must be positive")
+	}
+	if c.Replication.Interval.Duration <= 0 {
+		return fmt.Errorf("replication interval must be positive")
+	}
+	if c.Scrub.Interval.Duration <= 0 {
+		return fmt.Errorf("scrub interval must be positive")
+	}
+	if c.Erasure.Codec == "" {
+		return fmt.Errorf("erasure codec must be set")
+	}
+	if c.Erasure.DataShards <= 0 || c.Erasure.ParityShards < 0 || c.Erasure.LocalGroups < 0 ||
+		c.Erasure.DataShards+c.Erasure.ParityShards+c.Erasure.LocalGroups > 256 {
+		return fmt.Errorf("invalid erasure layout %d+%d+%d", c.Erasure.DataShards, c.Erasure.ParityShards, c.Erasure.LocalGroups)
+	}
+	return nil
+}
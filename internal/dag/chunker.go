@@ -0,0 +1,68 @@
+package dag
+
+import (
+	"math/bits"
+
+	"obscure-fs-rebuild/internal/utils"
+)
+
+// gear maps every byte to a fixed pseudo-random value for the rolling hash.
+// The table is derived from a constant seed and must never change, since
+// chunk boundaries and therefore every file CID depend on it.
+var gear [256]uint64
+
+var (
+	avgBits = bits.Len(utils.ChunkAvgSize) - 1
+
+	// a harder mask below the average size and an easier one above it keeps
+	// chunk sizes close to the average (FastCDC normalized chunking)
+	maskSmall = ^uint64(0) << (64 - (avgBits + 2))
+	maskLarge = ^uint64(0) << (64 - (avgBits - 2))
+)
+
+func init() {
+	seed := uint64(0x6f627363757265)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// boundary returns the length of the first chunk in data. Callers must pass
+// at least utils.ChunkMaxSize bytes unless data is the tail of the input,
+// otherwise boundaries would depend on how the input was buffered.
+func boundary(data []byte) int {
+	n := len(data)
+	if n <= utils.ChunkMinSize {
+		return n
+	}
+	if n > utils.ChunkMaxSize {
+		n = utils.ChunkMaxSize
+	}
+
+	normal := utils.ChunkAvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := utils.ChunkMinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
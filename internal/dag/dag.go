@@ -0,0 +1,186 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"obscure-fs-rebuild/internal/utils"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// A file is a list of raw blocks cut by content-defined chunking, tied
+// together by a root node whose CID identifies the file. The root node is
+// encoded as dag-json, so its field names are kept in sorted order.
+
+type Ref struct {
+	CID string `json:"/"`
+}
+
+type Link struct {
+	CID  Ref   `json:"cid"`
+	Size int64 `json:"size"`
+}
+
+type Node struct {
+	Links []Link `json:"links"`
+	Size  int64  `json:"size"`
+}
+
+// PutFunc stores a block. data is only valid for the duration of the call.
+type PutFunc func(cid string, data []byte) error
+
+func sum(codec uint64, data []byte) (string, error) {
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		return "", err
+	}
+
+	return cid.NewCidV1(codec, mh).String(), nil
+}
+
+func RawCID(data []byte) (string, error) {
+	return sum(cid.Raw, data)
+}
+
+func NodeCID(data []byte) (string, error) {
+	return sum(cid.DagJSON, data)
+}
+
+// JSON is the multicodec of plain JSON documents, such as file manifests,
+// which are blocks of their own but link to nothing.
+const JSON = 0x0200
+
+func JSONCID(data []byte) (string, error) {
+	return sum(JSON, data)
+}
+
+// IsJSON reports whether c refers to a plain JSON document.
+func IsJSON(c string) bool {
+	parsed, err := cid.Decode(c)
+	return err == nil && parsed.Type() == JSON
+}
+
+// IsNode reports whether c refers to a root node rather than a raw block.
+func IsNode(c string) bool {
+	parsed, err := cid.Decode(c)
+	return err == nil && parsed.Type() == cid.DagJSON
+}
+
+func Decode(data []byte) (*Node, error) {
+	var node Node
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("malformed node: %w", err)
+	}
+
+	return &node, nil
+}
+
+// Builder chunks everything written to it and hands each block, and finally
+// the root node, to put. A nil put only computes the CID.
+type Builder struct {
+	put   PutFunc
+	buf   []byte
+	links []Link
+	size  int64
+}
+
+func NewBuilder(put PutFunc) *Builder {
+	return &Builder{
+		put:   put,
+		buf:   make([]byte, 0, 2*utils.ChunkMaxSize),
+		links: make([]Link, 0),
+	}
+}
+
+func (b *Builder) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	for len(b.buf) >= utils.ChunkMaxSize {
+		if err := b.cut(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *Builder) cut() error {
+	n := boundary(b.buf)
+	chunk := b.buf[:n]
+
+	c, err := RawCID(chunk)
+	if err != nil {
+		return err
+	}
+
+	if b.put != nil {
+		if err := b.put(c, chunk); err != nil {
+			return err
+		}
+	}
+
+	b.links = append(b.links, Link{CID: Ref{CID: c}, Size: int64(n)})
+	b.size += int64(n)
+	b.buf = append(b.buf[:0], b.buf[n:]...)
+	return nil
+}
+
+// Finish flushes the remaining input, stores the root node and returns its
+// CID.
+func (b *Builder) Finish() (string, error) {
+	for len(b.buf) > 0 {
+		if err := b.cut(); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(Node{Links: b.links, Size: b.size})
+	if err != nil {
+		return "", err
+	}
+
+	root, err := NodeCID(data)
+	if err != nil {
+		return "", err
+	}
+
+	if b.put != nil {
+		if err := b.put(root, data); err != nil {
+			return "", err
+		}
+	}
+
+	return root, nil
+}
+
+// Cat writes the content of the file rooted at root to w, reading blocks
+// through get.
+func Cat(root string, get func(cid string) ([]byte, error), w io.Writer) error {
+	data, err := get(root)
+	if err != nil {
+		return err
+	}
+
+	node, err := Decode(data)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range node.Links {
+		block, err := get(link.CID.CID)
+		if err != nil {
+			return err
+		}
+
+		if int64(len(block)) != link.Size {
+			return fmt.Errorf("block %s has %d bytes, expected %d", link.CID.CID, len(block), link.Size)
+		}
+
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Files are encrypted with AES-256-GCM in chunks of ChunkSize bytes, each
+// sealed on its own under a nonce made of its index and whether it is the
+// last one. Chunks can be decrypted independently, so ranges of a file can
+// be read without the rest, while dropping, reordering or truncating chunks
+// still fails to decrypt. The ciphertext has no header; what a file is
+// encrypted with is recorded in its metadata.
+
+const (
+	Convergent = "convergent"
+	Random     = "random"
+
+	KeySize   = 32
+	ChunkSize = 64 << 10
+	Overhead  = 16
+)
+
+var ErrDecrypt = errors.New("unable to decrypt, wrong key or damaged content")
+
+type Key []byte
+
+func (k Key) String() string {
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+func ParseKey(s string) (Key, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("invalid encryption key")
+	}
+	return key, nil
+}
+
+// ValidateMode checks an encryption mode, empty meaning none.
+func ValidateMode(mode string) error {
+	switch mode {
+	case "", Convergent, Random:
+		return nil
+	}
+	return fmt.Errorf("unknown encryption mode: %q, use %s or %s", mode, Convergent, Random)
+}
+
+// NewKey returns the key a file is encrypted with. Convergent keys are
+// derived from the content, so equal files encrypt to the same ciphertext
+// and are still deduplicated, at the cost of revealing that two files are
+// equal. Random keys reveal nothing but never deduplicate.
+func NewKey(mode string, content io.Reader) (Key, error) {
+	switch mode {
+	case Convergent:
+		hash := sha256.New()
+		hash.Write([]byte("obscure-fs convergent key v1\n"))
+		if _, err := io.Copy(hash, content); err != nil {
+			return nil, err
+		}
+		return hash.Sum(nil), nil
+
+	case Random:
+		key := make(Key, KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, ValidateMode(mode)
+}
+
+func newAEAD(key Key) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("invalid encryption key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(index int64, final bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n, uint64(index))
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+// Encrypt writes src encrypted with key to dst, a chunk at a time.
+func Encrypt(dst io.Writer, src io.Reader, key Key) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, ChunkSize)
+	buf := make([]byte, ChunkSize)
+	sealed := make([]byte, 0, ChunkSize+Overhead)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// a full chunk is the last one when nothing follows it, an empty
+		// file still gets a chunk so its end is authenticated
+		final := n < len(buf)
+		if !final {
+			_, err := r.Peek(1)
+			if err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], nonce(index, final), buf[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// CiphertextSize returns the encrypted size of size bytes.
+func CiphertextSize(size int64) int64 {
+	chunks := max(1, (size+ChunkSize-1)/ChunkSize)
+	return size + chunks*Overhead
+}
+
+// PlaintextSize returns the decrypted size of size bytes of ciphertext.
+func PlaintextSize(size int64) (int64, error) {
+	chunks := (size + ChunkSize + Overhead - 1) / (ChunkSize + Overhead)
+	if chunks == 0 || size-(chunks-1)*(ChunkSize+Overhead) < Overhead {
+		return 0, ErrDecrypt
+	}
+	return size - chunks*Overhead, nil
+}
+
+// Reader decrypts a file as it is read. It only holds the chunk under the
+// read offset and seeks without decrypting what it skips.
+type Reader struct {
+	src    io.ReaderAt
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+	offset int64
+
+	index int64
+	plain []byte
+	buf   []byte
+}
+
+// NewReader decrypts the size bytes of ciphertext in src. The first chunk
+// is checked right away, so a wrong key fails here rather than mid-read.
+func NewReader(src io.ReaderAt, size int64, key Key) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plainSize, err := PlaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		src:    src,
+		aead:   aead,
+		size:   plainSize,
+		chunks: (size + ChunkSize + Overhead - 1) / (ChunkSize + Overhead),
+		index:  -1,
+		buf:    make([]byte, ChunkSize+Overhead),
+	}
+	if err := r.load(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the length of the decrypted file.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) load(index int64) error {
+	if index == r.index {
+		return nil
+	}
+
+	start := index * (ChunkSize + Overhead)
+	length := min(ChunkSize+Overhead, r.size+r.chunks*Overhead-start)
+	n, err := r.src.ReadAt(r.buf[:length], start)
+	if int64(n) < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	r.plain, err = r.aead.Open(r.plain[:0], nonce(index, index == r.chunks-1), r.buf[:length], nil)
+	if err != nil {
+		r.index = -1
+		return ErrDecrypt
+	}
+	r.index = index
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / ChunkSize
+	if err := r.load(index); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, r.plain[r.offset-index*ChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
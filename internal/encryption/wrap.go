@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// A key is wrapped for a recipient's X25519 public key: an ephemeral key
+// pair is agreed with the recipient's key, and the hash of the shared secret
+// and both public keys encrypts the file key. The wrapped key is the
+// ephemeral public key followed by the sealed file key, so only the holder
+// of the recipient's private key can unwrap it.
+
+// NewIdentity generates an X25519 key pair to receive wrapped keys with.
+func NewIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func EncodeIdentity(identity *ecdh.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(identity.Bytes())
+}
+
+func ParseIdentity(s string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid identity")
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+func EncodeRecipient(recipient *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(recipient.Bytes())
+}
+
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid recipient")
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+func wrappingKey(secret, ephemeral, recipient []byte) Key {
+	hash := sha256.New()
+	hash.Write([]byte("obscure-fs key wrap v1\n"))
+	hash.Write(secret)
+	hash.Write(ephemeral)
+	hash.Write(recipient)
+	return hash.Sum(nil)
+}
+
+// WrapKey encrypts key so that only recipient can recover it.
+func WrapKey(key Key, recipient *ecdh.PublicKey) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	// the wrapping key is never reused, so a fixed nonce is safe
+	aead, err := newAEAD(wrappingKey(secret, ephemeral.PublicKey().Bytes(), recipient.Bytes()))
+	if err != nil {
+		return "", err
+	}
+
+	wrapped := aead.Seal(ephemeral.PublicKey().Bytes(), nonce(0, true), key, nil)
+	return base64.RawURLEncoding.EncodeToString(wrapped), nil
+}
+
+// UnwrapKey recovers a key wrapped for identity's public key.
+func UnwrapKey(wrapped string, identity *ecdh.PrivateKey) (Key, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil || len(raw) != 32+KeySize+Overhead {
+		return nil, errors.New("invalid wrapped key")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(raw[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(wrappingKey(secret, raw[:32], identity.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := aead.Open(nil, nonce(0, true), raw[32:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
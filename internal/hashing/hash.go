@@ -2,13 +2,84 @@ package hashing
 
 import (
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 
+	"obscure-fs-rebuild/internal/dag"
+
 	"github.com/ipfs/go-cid"
 	"github.com/multiformats/go-multihash"
 )
 
+var ErrHashMismatch = errors.New("content does not match CID")
+
+// Hasher computes the CID of everything written to it, so content can be
+// verified while it is being streamed.
+type Hasher struct {
+	writer io.Writer
+	sum    func() (string, error)
+}
+
+// NewHasher computes file CIDs, which are the root of the chunked DAG.
+func NewHasher() *Hasher {
+	builder := dag.NewBuilder(nil)
+	return &Hasher{writer: builder, sum: builder.Finish}
+}
+
+// BlockHasherFor hashes content as a single block, which is how blocks and
+// shards are addressed: the plain SHA-256 of the bytes under the same codec
+// as c, or raw when c is empty.
+func BlockHasherFor(c string) *Hasher {
+	codec := uint64(cid.Raw)
+	if parsed, err := cid.Decode(c); err == nil {
+		codec = parsed.Type()
+	}
+
+	hasher := sha256.New()
+	return &Hasher{
+		writer: hasher,
+		sum: func() (string, error) {
+			mh, err := multihash.Encode(hasher.Sum(nil), multihash.SHA2_256)
+			if err != nil {
+				return "", err
+			}
+			return cid.NewCidV1(codec, mh).String(), nil
+		},
+	}
+}
+
+// HasherFor returns the hasher that verifies a file against c. Files shared
+// before chunking was introduced are identified by a single raw block.
+func HasherFor(c string) *Hasher {
+	if dag.IsNode(c) {
+		return NewHasher()
+	}
+	return BlockHasherFor(c)
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	return h.writer.Write(p)
+}
+
+func (h *Hasher) CID() (string, error) {
+	return h.sum()
+}
+
+// Verify checks the written content against the expected CID.
+func (h *Hasher) Verify(expected string) error {
+	actual, err := h.CID()
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, expected, actual)
+	}
+	return nil
+}
+
 func HashFile(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -16,21 +87,47 @@ func HashFile(path string) (string, error) {
 	}
 	defer file.Close()
 
-	// Calculate SHA256 hash
-	hasher := sha256.New()
+	hasher := NewHasher()
 	if _, err := io.Copy(hasher, file); err != nil {
 		return "", err
 	}
-	hash := hasher.Sum(nil)
 
-	// Create multihash
-	mh, err := multihash.Encode(hash, multihash.SHA2_256)
+	return hasher.CID()
+}
+
+// VerifyFile checks the content of path against the expected CID.
+func VerifyFile(path, expected string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer file.Close()
+
+	hasher := HasherFor(expected)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return err
 	}
 
-	// Create CID
-	c := cid.NewCidV1(cid.Raw, mh)
+	return hasher.Verify(expected)
+}
+
+// VerifyBlock checks the content of path as a single block, the way blocks,
+// root nodes and shards are addressed.
+func VerifyBlock(path, expected string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := BlockHasherFor(expected)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return err
+	}
+
+	return hasher.Verify(expected)
+}
 
-	return c.String(), nil
+func HashBytes(buf []byte) (string, error) {
+	return dag.RawCID(buf)
 }
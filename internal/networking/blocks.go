@@ -0,0 +1,139 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/utils"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// storeBlocks chunks the file into the blockstore and returns the CID of its
+// root node, which identifies the file.
+func storeBlocks(blocks *storage.Blockstore, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	builder := dag.NewBuilder(blocks.Put)
+	if _, err := io.Copy(builder, file); err != nil {
+		return "", err
+	}
+
+	return builder.Finish()
+}
+
+// assembleBlocks writes the file rooted at root from the blockstore to
+// outputPath.
+func assembleBlocks(blocks *storage.Blockstore, root, outputPath string) error {
+	if !dag.IsNode(root) {
+		return fmt.Errorf("CID: %s is not a DAG root", root)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(dag.Cat(root, blocks.Get, writer))
+	}()
+	defer reader.Close()
+
+	return utils.WriteFileAtomic(outputPath, reader, -1)
+}
+
+func (n *Network) fetchBlock(ctx context.Context, peerID peer.ID, c string) error {
+	req := Request{Type: MsgGetBlock, CID: c}
+	return n.fetchResumable(ctx, peerID, req, c, n.fileStore.Blocks().Path(c), hashing.BlockHasherFor(c), c)
+}
+
+func (n *Network) fetchBlockFromAny(ctx context.Context, c string, providers []peer.ID, start int) error {
+	var lastErr error
+	for j := range providers {
+		provider := providers[(start+j)%len(providers)]
+		lastErr = n.fetchBlock(ctx, provider, c)
+		if lastErr == nil {
+			return nil
+		}
+		log.Printf("failed to fetch block %s from peer: %s, error: %v\n", c, provider, lastErr)
+	}
+	return lastErr
+}
+
+// downloadBlocks fetches the root node and every block it links to that is
+// not stored locally yet, spreading the blocks over the providers, and then
+// assembles the file. Blocks are verified against their CIDs as they arrive,
+// and the root against the file CID, so the result needs no further checks.
+func (n *Network) downloadBlocks(root string, providers []peer.ID, outputPath string) error {
+	if !dag.IsNode(root) {
+		return fmt.Errorf("CID: %s is not a DAG root", root)
+	}
+
+	blocks := n.fileStore.Blocks()
+	if !blocks.Has(root) {
+		if err := n.fetchBlockFromAny(n.ctx, root, providers, 0); err != nil {
+			return err
+		}
+	}
+
+	data, err := blocks.Get(root)
+	if err != nil {
+		return err
+	}
+
+	node, err := dag.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	queue := make(chan int, len(node.Links))
+	missing := int64(0)
+	for i, link := range node.Links {
+		if !blocks.Has(link.CID.CID) {
+			missing += link.Size
+			queue <- i
+		}
+	}
+	close(queue)
+
+	// the missing blocks and the assembled file
+	if err := n.reserveCapacity(missing + node.Size); err != nil {
+		return err
+	}
+	defer n.releaseCapacity(missing + node.Size)
+	log.Printf("fetching %d of %d blocks for %s\n", len(queue), len(node.Links), root)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failure error
+	)
+	for w := 0; w < maxParallelFetches; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				err := n.fetchBlockFromAny(n.ctx, node.Links[i].CID.CID, providers, i)
+				if err != nil {
+					mu.Lock()
+					failure = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+
+	return assembleBlocks(blocks, root, outputPath)
+}
@@ -0,0 +1,396 @@
+package networking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// number of shards fetched at the same time by a single download
+const maxParallelFetches = 4
+
+// rankProviders orders providers so that connected, low-latency peers are
+// tried first. This node is never part of the result.
+func (n *Network) rankProviders(providers []peer.AddrInfo) []peer.ID {
+	peers := make([]peer.ID, 0, len(providers))
+	for _, provider := range providers {
+		if provider.ID == n.host.ID() {
+			continue
+		}
+		if len(provider.Addrs) > 0 {
+			n.host.Peerstore().AddAddrs(provider.ID, provider.Addrs, peerstore.TempAddrTTL)
+		}
+		peers = append(peers, provider.ID)
+	}
+
+	connected := func(p peer.ID) bool {
+		return n.host.Network().Connectedness(p) == network.Connected
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		if connected(peers[i]) != connected(peers[j]) {
+			return connected(peers[i])
+		}
+
+		// zero means no measurement yet, which sorts last
+		li := n.host.Peerstore().LatencyEWMA(peers[i])
+		lj := n.host.Peerstore().LatencyEWMA(peers[j])
+		if li == 0 || lj == 0 {
+			return li != 0
+		}
+		return li < lj
+	})
+
+	return peers
+}
+
+// fetchMetadataFrom asks each provider in turn for the file's metadata.
+func (n *Network) fetchMetadataFrom(providers []peer.ID, checksum string) (*storage.Metadata, error) {
+	var lastErr error
+	for _, provider := range providers {
+		metadata, err := n.fetchMetadata(provider, checksum)
+		if err != nil {
+			log.Printf("failed to fetch metadata of %s from peer: %s, error: %v\n", checksum, provider, err)
+			lastErr = err
+			continue
+		}
+
+		if metadata.Checksum != checksum {
+			lastErr = fmt.Errorf("inconsistent metadata for CID: %s from peer: %s", checksum, provider)
+			continue
+		}
+
+		// nothing in it but the layout and hashes is trusted
+		if err := metadata.Localize(); err != nil {
+			lastErr = fmt.Errorf("metadata from peer: %s: %w", provider, err)
+			continue
+		}
+
+		return metadata, nil
+	}
+
+	return nil, lastErr
+}
+
+// downloadShards pulls the file's shards from several peers at once, using
+// the metadata of the first provider that has it.
+func (n *Network) downloadShards(checksum string, providers []peer.ID, outputPath string) error {
+	metadata, err := n.fetchMetadataFrom(providers, checksum)
+	if err != nil {
+		return err
+	}
+	return n.downloadLayout(metadata, providers, outputPath)
+}
+
+// downloadLayout fetches the shards metadata describes and decodes them.
+// Intact shards already on this node are used as they are, the others are
+// tried on the peer they were placed on and then on every provider, rotated
+// so that different shards start on different providers.
+// Workers stop picking up shards as soon as enough of them arrived to decode.
+func (n *Network) downloadLayout(metadata *storage.Metadata, providers []peer.ID, outputPath string) error {
+	checksum := metadata.Checksum
+	err := metadata.Localize()
+	if err != nil {
+		return err
+	}
+
+	stored := storage.EstimateStoredSize(metadata.Size, metadata.Shards, metadata.Pairty+metadata.Groups)
+	err = n.reserveCapacity(stored)
+	if err != nil {
+		return err
+	}
+	defer n.releaseCapacity(stored)
+
+	err = os.MkdirAll(filepath.Dir(storage.ShardPath(checksum, 0)), 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+
+	// data shards come first so parity is only fetched to replace failures
+	queue := make(chan int, len(metadata.Parts))
+	for i := range metadata.Parts {
+		queue <- i
+	}
+	close(queue)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		fetched int
+	)
+	for w := 0; w < maxParallelFetches; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+
+				if !n.fetchShardFromAny(ctx, metadata, i, n.shardSources(metadata, i, providers)) {
+					continue
+				}
+
+				mu.Lock()
+				fetched++
+				if fetched >= metadata.Shards {
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetched < metadata.Shards {
+		return fmt.Errorf("only %d of %d required shards available for CID: %s", fetched, metadata.Shards, checksum)
+	}
+
+	c, err := codec.For(metadata)
+	if err != nil {
+		return err
+	}
+
+	err = c.Decode(metadata, outputPath)
+	if err != nil {
+		return err
+	}
+
+	// the metadata came from a peer too, so check the end result
+	err = hashing.VerifyFile(outputPath, checksum)
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+func (n *Network) shardSources(metadata *storage.Metadata, index int, providers []peer.ID) []peer.ID {
+	sources := make([]peer.ID, 0, len(providers)+1)
+	if index < len(metadata.Locations) {
+		if location, err := peer.Decode(metadata.Locations[index]); err == nil && location != n.host.ID() {
+			sources = append(sources, location)
+		}
+	}
+
+	for j := range providers {
+		provider := providers[(index+j)%len(providers)]
+		if len(sources) > 0 && sources[0] == provider {
+			continue
+		}
+		sources = append(sources, provider)
+	}
+
+	return sources
+}
+
+// fetchShardFromAny fetches shard index of the file from the first of
+// sources that has it. A shard this node already holds is kept when it
+// matches its hash; without a hash it can't be told apart from a damaged one,
+// so it is fetched again.
+func (n *Network) fetchShardFromAny(ctx context.Context, metadata *storage.Metadata, index int, sources []peer.ID) bool {
+	path := metadata.Parts[index]
+	expected := metadata.ShardHash(index)
+	if expected != "" && hashing.VerifyBlock(path, expected) == nil {
+		return true
+	}
+
+	for _, source := range sources {
+		err := n.fetchShard(ctx, source, metadata.Checksum, index, path, expected)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("failed to fetch shard %s.%d from peer: %s, error: %v\n", metadata.Checksum, index, source, err)
+	}
+
+	return false
+}
+
+// fetchResumable downloads the payload of req to destPath. Bytes are appended
+// to a partial file under <PartialPath>/<peer-id> as they arrive, so a transfer
+// that was interrupted, even by a crash, continues from the last byte on disk.
+// The partial file is only trusted once all of it, run through hasher, hashes
+// to expected; on a mismatch it is discarded so the next attempt starts over.
+// An empty expected skips verification.
+func (n *Network) fetchResumable(ctx context.Context, peerID peer.ID, req Request, name, destPath string, hasher *hashing.Hasher, expected string) error {
+	partialDir := fmt.Sprintf("%s/%s", internalutils.PartialPath, n.host.ID())
+	err := os.MkdirAll(partialDir, 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	partialPath := fmt.Sprintf("%s/%s.part", partialDir, name)
+	unlock := n.partials.lock(partialPath)
+	defer unlock()
+	n.partials.expire(partialDir)
+
+	// a partial this old is unlikely to match what the peer serves now
+	if info, err := os.Stat(partialPath); err == nil && time.Since(info.ModTime()) > internalutils.PartialExpiry {
+		os.Remove(partialPath)
+	}
+
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer partial.Close()
+
+	// re-hash what is already there, which also leaves us at the end of it
+	offset, err := io.Copy(hasher, partial)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		log.Printf("resuming %s from byte %d\n", name, offset)
+	}
+
+	req.Offset = offset
+	err = n.roundTrip(ctx, peerID, req, nil, func(body io.Reader, resp Response) error {
+		if offset+resp.Size != resp.Total {
+			return fmt.Errorf("peer returned %d bytes from %d, expected up to %d", resp.Size, offset, resp.Total)
+		}
+
+		// callers fetching blocks and shards check the whole file up front,
+		// whole files only tell their size here
+		if req.Type == MsgGetFile {
+			if err := n.reserveCapacity(resp.Size); err != nil {
+				return err
+			}
+			defer n.releaseCapacity(resp.Size)
+		}
+
+		written, err := io.Copy(io.MultiWriter(partial, hasher), body)
+		if syncErr := partial.Sync(); err == nil {
+			err = syncErr
+		}
+		if err == nil && written != resp.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+
+	if err != nil {
+		// the peer may not agree with what we have, start over next time
+		var peerErr *PeerError
+		if errors.As(err, &peerErr) || offset == 0 && fileSize(partial) == 0 {
+			os.Remove(partialPath)
+		}
+		return err
+	}
+
+	if expected != "" {
+		err = hasher.Verify(expected)
+		if err != nil {
+			os.Remove(partialPath)
+			return err
+		}
+	}
+
+	err = partial.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partialPath, destPath)
+}
+
+// partials guards the partial files of downloads in progress. Fetches of the
+// same partial run one at a time, as they would otherwise append to it at
+// once.
+type partials struct {
+	mu      sync.Mutex
+	locks   map[string]*partialLock
+	expired time.Time
+}
+
+type partialLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the partial file at path and returns its unlock function.
+func (p *partials) lock(path string) func() {
+	p.mu.Lock()
+	if p.locks == nil {
+		p.locks = make(map[string]*partialLock)
+	}
+	l := p.locks[path]
+	if l == nil {
+		l = &partialLock{}
+		p.locks[path] = l
+	}
+	l.waiters++
+	p.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(p.locks, path)
+		}
+	}
+}
+
+// expire removes partial files in dir that no download touched for
+// internalutils.PartialExpiry, at most once per GC grace period.
+func (p *partials) expire(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.expired) < internalutils.GCGracePeriod {
+		return
+	}
+	p.expired = time.Now()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// named like fetchResumable names them, so held locks match
+		path := fmt.Sprintf("%s/%s", dir, entry.Name())
+		if filepath.Ext(path) != ".part" || p.locks[path] != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > internalutils.PartialExpiry {
+			log.Printf("removing stale partial download: %s\n", path)
+			os.Remove(path)
+		}
+	}
+}
+
+func fileSize(file *os.File) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
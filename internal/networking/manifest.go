@@ -0,0 +1,97 @@
+package networking
+
+import (
+	"fmt"
+	"log"
+
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/storage"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// publishManifest stores the manifest of metadata and announces it, so other
+// nodes can rebuild the file from the manifest CID alone. The metadata
+// still has to be saved.
+func (n *Network) publishManifest(metadata *storage.Metadata) error {
+	err := n.fileStore.PutManifest(metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := n.AnnounceFile(metadata.Manifest); err != nil {
+		log.Printf("Failed to announce manifest %s: %v\n", metadata.Manifest, err)
+	}
+	return nil
+}
+
+// FetchManifest returns the manifest stored under c, fetching it from a
+// provider when it isn't stored locally. Fetched manifests are verified
+// against c before they are read.
+func (n *Network) FetchManifest(c string) (*storage.Manifest, error) {
+	if !dag.IsJSON(c) {
+		return nil, fmt.Errorf("CID: %s is not a manifest", c)
+	}
+
+	if !n.fileStore.Blocks().Has(c) {
+		providers, err := n.FindFile(c)
+		if err != nil || len(providers) == 0 {
+			return nil, fmt.Errorf("no providers found for manifest: %s", c)
+		}
+
+		peers := n.rankProviders(providers)
+		if len(peers) == 0 {
+			return nil, fmt.Errorf("no remote providers found for manifest: %s", c)
+		}
+
+		if err := n.fetchBlockFromAny(n.ctx, c, peers, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return n.fileStore.GetManifest(c)
+}
+
+// retrieveManifest rebuilds the file a manifest describes into outputPath.
+// The shards are fetched from where the manifest placed them and from the
+// providers of the file and of the manifest, so no peer has to serve its
+// metadata.
+func (n *Network) retrieveManifest(c, outputPath string) error {
+	manifest, err := n.FetchManifest(c)
+	if err != nil {
+		return err
+	}
+
+	err = decodeLocal(n.fileStore, manifest.CID, outputPath)
+	if err == nil {
+		return nil
+	}
+
+	found := make([]peer.AddrInfo, 0)
+	seen := make(map[peer.ID]bool)
+	for _, id := range []string{manifest.CID, c} {
+		providers, err := n.FindFile(id)
+		if err != nil {
+			continue
+		}
+		for _, provider := range providers {
+			if !seen[provider.ID] {
+				seen[provider.ID] = true
+				found = append(found, provider)
+			}
+		}
+	}
+	peers := n.rankProviders(found)
+
+	err = n.downloadLayout(manifest.Metadata(), peers, outputPath)
+	if err == nil {
+		log.Printf("file %s retrieved from manifest %s and saved at: %s\n", manifest.CID, c, outputPath)
+		return nil
+	}
+
+	if len(peers) == 0 || !dag.IsNode(manifest.CID) {
+		return err
+	}
+	log.Printf("failed to retrieve shards of %s, falling back to blocks, error: %v\n", manifest.CID, err)
+	return n.downloadBlocks(manifest.CID, peers, outputPath)
+}
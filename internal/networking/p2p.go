@@ -11,18 +11,20 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/encryption"
 	"obscure-fs-rebuild/internal/storage"
-	"obscure-fs-rebuild/utils"
+	internalutils "obscure-fs-rebuild/internal/utils"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-kad-dht/dual"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -36,6 +38,12 @@ type Network struct {
 	dht            *dual.DHT
 	bootstrapNodes []string
 	fileStore      *storage.FileStore
+	reprovider     *Reprovider
+	replicator     *Replicator
+	scrubber       *Scrubber
+	shareDefaults  ShareOptions
+	capacity       int64
+	partials       partials
 }
 
 func NewNetwork(ctx context.Context, port int, pkey string, bootstrapNodes []string, fs *storage.FileStore) *Network {
@@ -70,14 +78,17 @@ func NewNetwork(ctx context.Context, port int, pkey string, bootstrapNodes []str
 	}
 
 	log.Printf("Host created. Listening on: %s\n", host.Addrs())
-	return &Network{
+	n := &Network{
 		ctx:            ctx,
 		port:           port,
 		host:           host,
 		dht:            dhtInstance,
 		bootstrapNodes: bootstrapNodes,
 		fileStore:      fs,
+		shareDefaults:  ShareOptions{Codec: codec.ReedSolomonID, Shards: internalutils.Shards, Parity: internalutils.Pairty},
 	}
+	n.replicator = newReplicator(n)
+	return n
 }
 
 func (n *Network) GetHost() host.Host {
@@ -112,30 +123,218 @@ func (n *Network) FindFile(id string) ([]peer.AddrInfo, error) {
 	return peers, nil
 }
 
-func (n *Network) ShareFile(path string) (cid string, err error) {
-	cid, err = hashing.HashFile(path)
+// ShareOptions tune how a shared file is stored, zero values pick the node's
+// defaults.
+type ShareOptions struct {
+	Replication int
+
+	// codec and its layout, an empty Codec picks the node's default and a
+	// zero Shards the codec's default layout
+	Codec  string
+	Shards int
+	Parity int
+	Groups int
+
+	// media type served with the file, detected from the name and content
+	// when empty
+	ContentType string
+
+	// encryption mode, see encryption.NewKey. Empty stores the file as is.
+	Encryption string
+}
+
+// SetCapacity limits what peers can make this node store, zero meaning no
+// limit.
+func (n *Network) SetCapacity(capacity int64) {
+	n.capacity = capacity
+}
+
+// reserveCapacity holds size bytes of the node's capacity until
+// releaseCapacity.
+func (n *Network) reserveCapacity(size int64) error {
+	tempDir := fmt.Sprintf("%s/%s", internalutils.TempPath, n.host.ID())
+	return n.fileStore.ReserveCapacity(n.capacity, size, tempDir)
+}
+
+func (n *Network) releaseCapacity(size int64) {
+	n.fileStore.ReleaseCapacity(size)
+}
+
+// ShareDefaults returns the codec and layout of files shared without one.
+func (n *Network) ShareDefaults() ShareOptions {
+	return n.shareDefaults
+}
+
+func (n *Network) SetShareDefaults(opts ShareOptions) {
+	n.shareDefaults = opts
+}
+
+// ShareFile stores the file at path and places its shards on other peers.
+// With opts.Encryption set the file is encrypted first and the key is
+// returned; neither this node nor its peers keep the key, the plaintext, its
+// name or its media type.
+func (n *Network) ShareFile(path string, opts ShareOptions) (cid string, key encryption.Key, err error) {
+	if opts.Encryption == "" {
+		cid, err = n.storeFile(path, filepath.Base(path), opts, true)
+		return
+	}
+
+	key, encrypted, err := encryptFile(path, opts.Encryption)
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(encrypted)
+
+	opts.ContentType = "application/octet-stream"
+	cid, err = n.storeFile(encrypted, "encrypted", opts, true)
+	if err != nil {
+		return "", nil, err
+	}
+	return cid, key, nil
+}
+
+// encryptFile writes an encrypted copy of the file at path to the temp
+// directory and returns the key and the copy's path.
+func encryptFile(path, mode string) (key encryption.Key, encrypted string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// convergent keys hash the whole file, encryption reads it again
+	key, err = encryption.NewKey(mode, file)
+	if err != nil {
+		return
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	err = os.MkdirAll(internalutils.TempPath, 0755)
+	if err != nil {
+		return
+	}
+	out, err := os.CreateTemp(internalutils.TempPath, "encrypt-")
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	err = encryption.Encrypt(out, file, key)
+	if err != nil {
+		os.Remove(out.Name())
+		return nil, "", err
+	}
+	return key, out.Name(), nil
+}
+
+// storeFile chunks and erasure codes the file at path, stores it under its
+// CID and announces it. Shards are pushed to other peers when place is set.
+func (n *Network) storeFile(path, name string, opts ShareOptions, place bool) (cid string, err error) {
+	if opts.Codec == "" {
+		opts.Codec = n.shareDefaults.Codec
+		if opts.Shards == 0 {
+			opts.Shards, opts.Parity, opts.Groups = n.shareDefaults.Shards, n.shareDefaults.Parity, n.shareDefaults.Groups
+		}
+	}
+
+	c, err := codec.Get(opts.Codec)
+	if err != nil {
+		return
+	}
+	if opts.Shards == 0 {
+		opts.Shards, opts.Parity, opts.Groups = c.Layout()
+	}
+	if err = c.Validate(opts.Shards, opts.Parity, opts.Groups); err != nil {
+		return
+	}
+
+	release := n.fileStore.Hold()
+	defer release()
+
+	cid, err = storeBlocks(n.fileStore.Blocks(), path)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
 		return
 	}
+	defer file.Close()
 
-	err = n.fileStore.StoreFile(cid, path)
+	info, err := file.Stat()
 	if err != nil {
 		return
 	}
 
-	err = n.AnnounceFile(cid)
+	if opts.ContentType == "" {
+		// sniffing never looks past the first 512 bytes
+		head := make([]byte, 512)
+		n, _ := file.ReadAt(head, 0)
+		opts.ContentType = storage.DetectContentType(name, head[:n])
+	}
+
+	metadata := &storage.Metadata{
+		Name:        name,
+		ContentType: opts.ContentType,
+		Checksum:    cid,
+		Codec:       opts.Codec,
+		Shards:      opts.Shards,
+		Pairty:      opts.Parity,
+		Groups:      opts.Groups,
+		Replication: opts.Replication,
+		Encryption:  opts.Encryption,
+	}
+
+	err = c.Encode(metadata, file, info.Size())
 	if err != nil {
 		return
 	}
 
-	log.Printf("File shared with CID: %s\n", cid)
+	if place {
+		n.PlaceShards(metadata)
+	} else {
+		n.keepShards(metadata)
+	}
+
+	err = n.publishManifest(metadata)
+	if err != nil {
+		return
+	}
+
+	metadataPath := storage.MetadataPath(cid)
+	err = storage.SaveMetadata(metadataPath, metadata)
+	if err != nil {
+		return
+	}
+
+	err = n.fileStore.StoreFile(cid, metadataPath)
+	if err != nil {
+		return
+	}
+
+	// An empty routing table is not fatal here; the reprovider announces the
+	// file again once peers are known.
+	if err := n.AnnounceFile(cid); err != nil {
+		log.Printf("Failed to announce %s: %v\n", cid, err)
+	}
+
+	log.Printf("File stored with CID: %s\n", cid)
 	return cid, nil
 }
 
+// RetrieveFile saves the content of cid to outputPath. A manifest CID
+// retrieves the file the manifest describes.
 func (n *Network) RetrieveFile(cid, outputPath string) error {
-	path, err := n.fileStore.GetFile(cid)
+	if dag.IsJSON(cid) {
+		return n.retrieveManifest(cid, outputPath)
+	}
+
+	err := decodeLocal(n.fileStore, cid, outputPath)
 	if err == nil {
-		return utils.CopyFile(path, outputPath)
+		return nil
 	}
 
 	log.Printf("file not found locally! searching on the n/w for file: %s", cid)
@@ -146,35 +345,37 @@ func (n *Network) RetrieveFile(cid, outputPath string) error {
 
 	fmt.Printf("providers: %v\n", providers)
 
-	for _, provider := range providers {
-		stream, err := n.host.NewStream(n.ctx, provider.ID, utils.ProtocolID)
-		if err != nil {
-			log.Printf("failed to open stream with provider: %s, error: %v\n", provider.ID.String(), err)
-			continue
-		}
-		defer stream.Close()
+	peers := n.rankProviders(providers)
+	if len(peers) == 0 {
+		return fmt.Errorf("no remote providers found for CID: %s", cid)
+	}
 
-		_, err = stream.Write([]byte(cid))
-		if err != nil {
-			log.Printf("failed to send CID to provider: %s, error: %v\n", provider.ID.String(), err)
-			continue
-		}
+	err = n.downloadBlocks(cid, peers, outputPath)
+	if err == nil {
+		log.Printf("file retrieved successfully and saved at: %s\n", outputPath)
+		return nil
+	}
+	log.Printf("failed to retrieve blocks of %s, falling back to shards, error: %v\n", cid, err)
 
-		fileData, err := io.ReadAll(stream)
-		if err != nil {
-			log.Printf("Failed to read file data from provider: %s, error: %v\n", provider.ID.String(), err)
-			continue
-		}
+	err = n.downloadShards(cid, peers, outputPath)
+	if err == nil {
+		log.Printf("file retrieved successfully and saved at: %s\n", outputPath)
+		return nil
+	}
+	log.Printf("failed to retrieve shards of %s, falling back to full transfer, error: %v\n", cid, err)
 
-		err = os.WriteFile(outputPath, fileData, 0644)
+	for _, provider := range peers {
+		err = n.RequestFile(provider, cid, outputPath)
 		if err != nil {
-			return fmt.Errorf("failed to save file to path: %s, error: %w", outputPath, err)
+			log.Printf("failed to retrieve file from provider: %s, error: %v\n", provider.String(), err)
+			continue
 		}
 
 		log.Printf("file retrieved successfully and saved at: %s\n", outputPath)
+		return nil
 	}
 
-	return nil
+	return fmt.Errorf("unable to retrieve CID: %s from any provider: %w", cid, err)
 }
 
 func (n *Network) ConnectToBootstrapNodes() {
@@ -252,77 +453,50 @@ func (n *Network) AnnounceToPeers(nodeID, address string) {
 }
 
 func (n *Network) StartSimpleProtocol(protocolID protocol.ID) {
-	n.host.SetStreamHandler(protocolID, streamHandler(n.fileStore))
+	n.host.SetStreamHandler(protocolID, n.streamHandler())
 }
 
-func (n *Network) SendMessage(peerID peer.ID, protocolID protocol.ID, msg string) (err error) {
-	stream, err := n.host.NewStream(n.ctx, peerID, protocolID)
+// decodeLocal reassembles a locally stored file into outputPath from its
+// blocks, or from its shards when blocks are missing. Stored files are kept
+// as blocks and shards only, decoded copies live with the cached files.
+func decodeLocal(fileStore *storage.FileStore, cid, outputPath string) error {
+	path, err := fileStore.GetFile(cid)
 	if err != nil {
-		return
+		return err
 	}
-	defer stream.Close()
 
-	_, err = stream.Write([]byte(msg))
+	metadata, err := storage.LoadMetadata(path)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Message sent: %s\n", msg)
-	return nil
-}
+	err = assembleBlocks(fileStore.Blocks(), cid, outputPath)
+	if err == nil {
+		return nil
+	}
+	log.Printf("unable to assemble %s from blocks, decoding shards: %v\n", cid, err)
 
-func streamHandler(fileStore *storage.FileStore) network.StreamHandler {
-	return func(stream network.Stream) {
-		log.Println("new stream opened")
-		defer stream.Close()
+	c, err := codec.For(metadata)
+	if err != nil {
+		return err
+	}
+	return c.Decode(metadata, outputPath)
+}
 
-		buf := make([]byte, 256)
-		n, err := stream.Read(buf)
-		if err != nil {
-			log.Printf("error reading from stream: %s\n", err)
-			return
-		}
+// cachedCopy returns the path of a decoded copy of cid, decoding the locally
+// stored file when there is none yet. Copies are kept with the cached files,
+// so garbage collection drops them.
+func (n *Network) cachedCopy(cid string) (string, error) {
+	cacheDir := fmt.Sprintf("%s/%s", internalutils.TempPath, n.host.ID())
+	path := fmt.Sprintf("%s/%s", cacheDir, cid)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
 
-		command := string(buf[:n])
-		log.Printf("received command: %s\n", command)
-
-		switch command {
-		case "list_files":
-			files := fileStore.ListFiles()
-			response, err := json.Marshal(files)
-			if err != nil {
-				log.Printf("failed to encode file list: %s\n", err)
-				return
-			}
-			_, err = stream.Write(response)
-			if err != nil {
-				log.Printf("error writing file list to stream: %s\n", err)
-			} else {
-				log.Println("file list sent successfully")
-			}
-
-		default:
-			cid := command
-			path, err := fileStore.GetFile(cid)
-			if err != nil {
-				log.Printf("file not found for CID: %s\n", cid)
-				return
-			}
-
-			fileData, err := os.ReadFile(path)
-			if err != nil {
-				log.Printf("failed to read file: %s\n", err)
-				return
-			}
-
-			_, err = stream.Write(fileData)
-			if err != nil {
-				log.Printf("error writing file to stream: %s\n", err)
-			} else {
-				log.Printf("file sent successfully for CID: %s\n", cid)
-			}
-		}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
 	}
+	return path, decodeLocal(n.fileStore, cid, path)
 }
 
 func (n *Network) Shutdown() error {
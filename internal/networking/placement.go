@@ -0,0 +1,165 @@
+package networking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/utils"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	errStoredLocally = errors.New("refusing to overwrite a local file")
+	errShardExists   = errors.New("refusing to replace a stored shard")
+)
+
+// placementPeers lists the peers known to the DHT routing tables along with
+// currently connected peers, excluding this node.
+func (n *Network) placementPeers() []peer.ID {
+	seen := make(map[peer.ID]bool)
+	peers := make([]peer.ID, 0)
+
+	candidates := append(n.dht.WAN.RoutingTable().ListPeers(), n.dht.LAN.RoutingTable().ListPeers()...)
+	candidates = append(candidates, n.host.Network().Peers()...)
+	for _, p := range candidates {
+		if p == n.host.ID() || seen[p] {
+			continue
+		}
+		seen[p] = true
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// PlaceShards pushes every shard of the file to a different peer, wrapping
+// around when there are fewer peers than shards. Shards that can't be
+// placed stay local only and have an empty location.
+func (n *Network) PlaceShards(metadata *storage.Metadata) {
+	metadata.Locations = make([]string, len(metadata.Parts))
+
+	peers := n.placementPeers()
+	if len(peers) == 0 {
+		log.Printf("no peers available, keeping shards of %s local\n", metadata.Checksum)
+		return
+	}
+
+	next := 0
+	for i := range metadata.Parts {
+		for attempt := 0; attempt < len(peers); attempt++ {
+			target := peers[(next+attempt)%len(peers)]
+			err := n.pushShard(target, metadata, i)
+			if err != nil {
+				log.Printf("failed to place shard %s.%d on peer: %s, error: %v\n", metadata.Checksum, i, target, err)
+				continue
+			}
+
+			metadata.Locations[i] = target.String()
+			next += attempt + 1
+			break
+		}
+	}
+}
+
+// keepShards records every shard of the file as kept on this node, so
+// repairs don't push them elsewhere.
+func (n *Network) keepShards(metadata *storage.Metadata) {
+	metadata.Locations = make([]string, len(metadata.Parts))
+	for i := range metadata.Locations {
+		metadata.Locations[i] = n.host.ID().String()
+	}
+}
+
+// pushShard sends shard index of the file to a peer along with its hash, so
+// the peer can check what it receives.
+func (n *Network) pushShard(peerID peer.ID, metadata *storage.Metadata, index int) error {
+	file, err := os.Open(metadata.Parts[index])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req := Request{Type: MsgPutShard, CID: metadata.Checksum, Index: index, Size: info.Size(), Hash: metadata.ShardHash(index)}
+	return n.roundTrip(n.ctx, peerID, req, file, nil)
+}
+
+// fetchShard downloads a shard to path, rejecting it unless it hashes to
+// expected. An empty expected hash skips verification.
+func (n *Network) fetchShard(ctx context.Context, peerID peer.ID, checksum string, index int, path, expected string) error {
+	req := Request{Type: MsgGetShard, CID: checksum, Index: index}
+	return n.fetchResumable(ctx, peerID, req, fmt.Sprintf("%s.%d", checksum, index), path, hashing.BlockHasherFor(expected), expected)
+}
+
+func (n *Network) fetchMetadata(peerID peer.ID, checksum string) (*storage.Metadata, error) {
+	var metadata storage.Metadata
+	err := n.roundTrip(n.ctx, peerID, Request{Type: MsgGetMetadata, CID: checksum}, nil, func(body io.Reader, _ Response) error {
+		err := json.NewDecoder(body).Decode(&metadata)
+		if err != nil {
+			return fmt.Errorf("malformed metadata from peer: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// receiveShard stores a shard another node placed here, rejecting it unless
+// it hashes to expected. A shard without a hash is only taken when there is
+// none yet. Shards already here are never replaced, as the sender's hash is
+// no more trusted than its bytes; a damaged one is repaired by the scrubber
+// against the file's metadata instead. Shards of files stored on this node
+// are never touched.
+func (n *Network) receiveShard(reader io.Reader, checksum string, index int, size int64, expected string) error {
+	if index < 0 || index >= 256 || size < 0 {
+		return fmt.Errorf("invalid shard %d of size %d", index, size)
+	}
+	if _, err := n.fileStore.GetFile(checksum); err == nil {
+		return fmt.Errorf("%s is stored locally: %w", checksum, errStoredLocally)
+	}
+
+	path := storage.ShardPath(checksum, index)
+	if _, err := os.Stat(path); err == nil {
+		if expected != "" && hashing.VerifyBlock(path, expected) == nil {
+			// nothing to do, but the sender is still writing it
+			_, err := io.CopyN(io.Discard, reader, size)
+			return err
+		}
+		return fmt.Errorf("shard %s.%d: %w", checksum, index, errShardExists)
+	}
+
+	if err := n.reserveCapacity(size); err != nil {
+		return err
+	}
+	defer n.releaseCapacity(size)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	if expected == "" {
+		return utils.WriteFileAtomic(path, reader, size)
+	}
+
+	hasher := hashing.BlockHasherFor(expected)
+	return utils.WriteFileVerified(path, io.TeeReader(reader, hasher), size, func() error {
+		return hasher.Verify(expected)
+	})
+}
@@ -2,50 +2,361 @@ package networking
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strings"
 
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	"obscure-fs-rebuild/utils"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
-func (n *Network) RequestFile(peerID peer.ID, protocolID protocol.ID, cid string) error {
-	stream, err := n.host.NewStream(n.ctx, peerID, protocolID)
+// Every exchange on utils.ProtocolID is a single request frame, optionally
+// followed by a raw payload of Request.Size bytes, answered by a single
+// response frame and a raw payload of Response.Size bytes. A frame is a
+// uvarint length followed by that many bytes of JSON.
+
+const maxFrameSize = 1 << 20
+
+type MessageType uint8
+
+const (
+	MsgListFiles MessageType = iota + 1
+	MsgGetFile
+	MsgGetMetadata
+	MsgGetShard
+	MsgPutShard
+	MsgGetBlock
+	MsgReplicate
+)
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusBadRequest
+	StatusNotFound
+	StatusInternalError
+	StatusInsufficientStorage
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusNotFound:
+		return "not found"
+	case StatusInternalError:
+		return "internal error"
+	case StatusInsufficientStorage:
+		return "insufficient storage"
+	default:
+		return fmt.Sprintf("status(%d)", s)
+	}
+}
+
+type Request struct {
+	Type  MessageType `json:"type"`
+	CID   string      `json:"cid,omitempty"`
+	Index int         `json:"index,omitempty"`
+	Size  int64       `json:"size,omitempty"`
+
+	// expected hash of a pushed shard
+	Hash string `json:"hash,omitempty"`
+
+	// byte range of a file or shard to return, a zero length reads to the end
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+}
+
+type Response struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+
+	// full size of the file or shard a range was cut from
+	Total int64 `json:"total,omitempty"`
+}
+
+type PeerError struct {
+	Status  Status
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("error from peer: %s: %s", e.Status, e.Message)
+}
+
+func writeFrame(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	header := binary.AppendUvarint(nil, uint64(len(body)))
+	_, err = w.Write(append(header, body...))
+	return err
+}
+
+func readFrame(r *bufio.Reader, v any) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	if size > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", size)
+	}
+
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// roundTrip sends req, followed by req.Size bytes of payload when payload is
+// not nil, and hands the response payload along with the response frame to
+// handle. Non-OK responses are returned as *PeerError.
+func (n *Network) roundTrip(ctx context.Context, peerID peer.ID, req Request, payload io.Reader, handle func(body io.Reader, resp Response) error) error {
+	stream, err := n.host.NewStream(ctx, peerID, utils.ProtocolID)
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
 	defer stream.Close()
 
-	_, err = stream.Write([]byte(fmt.Sprintf("REQ:%s\n", cid)))
+	// abort transfers that are still running when the caller gives up
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+
+	err = writeFrame(stream, req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 
+	if payload != nil {
+		_, err = io.CopyN(stream, payload, req.Size)
+		if err != nil {
+			return fmt.Errorf("failed to send payload: %w", err)
+		}
+	}
+
 	reader := bufio.NewReader(stream)
-	response, err := reader.ReadString('\n')
+	var resp Response
+	err = readFrame(reader, &resp)
 	if err != nil {
 		return fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if strings.HasPrefix(response, "ERR:") {
-		return fmt.Errorf("error from peer: %s", strings.TrimPrefix(response, "ERR:"))
+	if resp.Status != StatusOK {
+		return &PeerError{Status: resp.Status, Message: resp.Error}
+	}
+
+	if handle == nil {
+		return nil
 	}
+	return handle(io.LimitReader(reader, resp.Size), resp)
+}
 
+func (n *Network) RequestFile(peerID peer.ID, cid, outputPath string) error {
 	log.Printf("File transfer started for CID: %s\n", cid)
-	file, err := os.Create(fmt.Sprintf("downloaded_%s", cid))
+	err := n.fetchResumable(n.ctx, peerID, Request{Type: MsgGetFile, CID: cid}, cid, outputPath, hashing.HasherFor(cid), cid)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
+	}
+
+	log.Printf("File successfully downloaded for CID: %s\n", cid)
+	return nil
+}
+
+func (n *Network) ListPeerFiles(peerID peer.ID) (map[string]string, error) {
+	var files map[string]string
+	err := n.roundTrip(n.ctx, peerID, Request{Type: MsgListFiles}, nil, func(body io.Reader, _ Response) error {
+		return json.NewDecoder(body).Decode(&files)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (n *Network) streamHandler() network.StreamHandler {
+	fileStore := n.fileStore
+	return func(stream network.Stream) {
+		log.Println("new stream opened")
+		defer stream.Close()
+
+		reader := bufio.NewReader(stream)
+		var req Request
+		err := readFrame(reader, &req)
+		if err != nil {
+			log.Printf("error reading from stream: %s\n", err)
+			respond(stream, StatusBadRequest, "malformed request")
+			return
+		}
+
+		log.Printf("received request: type=%d cid=%s\n", req.Type, req.CID)
+
+		// the CID ends up in paths, refuse anything that isn't one
+		if req.Type != MsgListFiles {
+			if _, err := cid.Decode(req.CID); err != nil {
+				respond(stream, StatusBadRequest, "invalid CID")
+				return
+			}
+		}
+
+		switch req.Type {
+		case MsgListFiles:
+			response, err := json.Marshal(fileStore.ListFiles())
+			if err != nil {
+				log.Printf("failed to encode file list: %s\n", err)
+				respond(stream, StatusInternalError, err.Error())
+				return
+			}
+			respondBytes(stream, response)
+
+		case MsgGetFile:
+			path, err := n.cachedCopy(req.CID)
+			if err != nil {
+				log.Printf("file not found for CID: %s, error: %v\n", req.CID, err)
+				respond(stream, StatusNotFound, "file not found")
+				return
+			}
+
+			respondFile(stream, path, req.Offset, req.Length)
+
+		case MsgGetMetadata:
+			path, err := fileStore.GetFile(req.CID)
+			if err != nil {
+				respond(stream, StatusNotFound, "file not found")
+				return
+			}
+
+			// streamed like any file, nothing a peer asks for is read whole
+			respondFile(stream, path, 0, 0)
+
+		case MsgGetShard:
+			respondFile(stream, storage.ShardPath(req.CID, req.Index), req.Offset, req.Length)
+
+		case MsgGetBlock:
+			respondFile(stream, fileStore.Blocks().Path(req.CID), req.Offset, req.Length)
+
+		case MsgPutShard:
+			// hosted shards aren't pinned, any peer can send them, so garbage
+			// collection can drop them when the node runs out of space
+			err := n.receiveShard(reader, req.CID, req.Index, req.Size, req.Hash)
+			if err != nil {
+				log.Printf("failed to store shard %s.%d: %v\n", req.CID, req.Index, err)
+				switch {
+				case errors.Is(err, storage.ErrInsufficientStorage):
+					respond(stream, StatusInsufficientStorage, err.Error())
+				case errors.Is(err, errStoredLocally), errors.Is(err, errShardExists), errors.Is(err, hashing.ErrHashMismatch):
+					respond(stream, StatusBadRequest, err.Error())
+				default:
+					respond(stream, StatusInternalError, err.Error())
+				}
+				return
+			}
+			log.Printf("stored shard: %s.%d\n", req.CID, req.Index)
+			respond(stream, StatusOK, "")
+
+		case MsgReplicate:
+			// req.Size is the requester's estimate, it stays reserved until
+			// the copy is stored and storeReplica adds to it once it has
+			// the metadata
+			if req.Size < 0 {
+				respond(stream, StatusBadRequest, "invalid size")
+				return
+			}
+			if err := n.reserveCapacity(req.Size); err != nil {
+				log.Printf("refusing a copy of %s: %v\n", req.CID, err)
+				respond(stream, StatusInsufficientStorage, err.Error())
+				return
+			}
+
+			// fetching the file may take a while, the requester checks the
+			// outcome through the DHT on its next round
+			respond(stream, StatusOK, "")
+			go n.replicate(req.CID, req.Size)
+
+		default:
+			respond(stream, StatusBadRequest, fmt.Sprintf("unknown message type: %d", req.Type))
+		}
+	}
+}
+
+func respond(stream network.Stream, status Status, message string) {
+	err := writeFrame(stream, Response{Status: status, Error: message})
+	if err != nil {
+		log.Printf("error writing response to stream: %s\n", err)
+	}
+}
+
+func respondBytes(stream network.Stream, payload []byte) {
+	err := writeFrame(stream, Response{Status: StatusOK, Size: int64(len(payload))})
+	if err == nil {
+		_, err = stream.Write(payload)
+	}
+	if err != nil {
+		log.Printf("error writing response to stream: %s\n", err)
+	}
+}
+
+func respondFile(stream network.Stream, path string, offset, length int64) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		respond(stream, StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		respond(stream, StatusInternalError, err.Error())
+		return
 	}
 	defer file.Close()
 
-	_, err = io.Copy(file, reader)
+	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+		respond(stream, StatusInternalError, err.Error())
+		return
 	}
 
-	log.Printf("File successfully downloaded for CID: %s\n", cid)
-	return nil
+	if offset < 0 || length < 0 || offset > info.Size() {
+		respond(stream, StatusBadRequest, fmt.Sprintf("invalid range %d+%d of %d bytes", offset, length, info.Size()))
+		return
+	}
+
+	size := info.Size() - offset
+	if length > 0 && length < size {
+		size = length
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		respond(stream, StatusInternalError, err.Error())
+		return
+	}
+
+	err = writeFrame(stream, Response{Status: StatusOK, Size: size, Total: info.Size()})
+	if err == nil {
+		_, err = io.CopyN(stream, file, size)
+	}
+	if err != nil {
+		log.Printf("error writing %s to stream: %s\n", path, err)
+		return
+	}
+	log.Printf("sent %s successfully\n", path)
 }
@@ -0,0 +1,413 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/config"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// how long a provider gets to accept a connection before it counts as gone
+const livenessTimeout = 10 * time.Second
+
+// ReplicationStatus describes the last repair round. The repair and replica
+// counters add up over the node's lifetime.
+type ReplicationStatus struct {
+	Running          bool      `json:"running"`
+	Checked          int       `json:"checked"`
+	UnderReplicated  int       `json:"under_replicated"`
+	RepairsRequested int       `json:"repairs_requested"`
+	RepairsFailed    int       `json:"repairs_failed"`
+	ShardsMoved      int       `json:"shards_moved"`
+	ShardsRebuilt    int       `json:"shards_rebuilt"`
+	Replicated       int       `json:"replicated"`
+	LastStart        time.Time `json:"last_start"`
+	LastFinish       time.Time `json:"last_finish"`
+}
+
+// Replicator keeps every stored file on its target number of nodes and its
+// shards on live peers, and takes on copies other nodes ask for.
+type Replicator struct {
+	network  *Network
+	cfg      config.ReplicationConfig
+	status   ReplicationStatus
+	inFlight map[string]bool
+	mu       sync.Mutex
+}
+
+func newReplicator(n *Network) *Replicator {
+	return &Replicator{
+		network:  n,
+		cfg:      config.Default().Replication,
+		inFlight: make(map[string]bool),
+	}
+}
+
+// StartReplicator checks the replication of every stored file each
+// cfg.Interval until the network's context is done.
+func (n *Network) StartReplicator(cfg config.ReplicationConfig) {
+	n.replicator.mu.Lock()
+	n.replicator.cfg = cfg
+	n.replicator.mu.Unlock()
+
+	go n.replicator.run()
+}
+
+func (n *Network) ReplicationStatus() ReplicationStatus {
+	n.replicator.mu.Lock()
+	defer n.replicator.mu.Unlock()
+	return n.replicator.status
+}
+
+func (r *Replicator) run() {
+	// give the DHT a full interval to fill up before judging providers
+	ticker := time.NewTicker(r.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.network.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.check()
+	}
+}
+
+func (r *Replicator) check() {
+	r.update(func(s *ReplicationStatus) {
+		s.Running = true
+		s.Checked = 0
+		s.UnderReplicated = 0
+		s.LastStart = time.Now()
+	})
+
+	for cid, path := range r.network.fileStore.ListFiles() {
+		metadata, err := storage.LoadMetadata(path)
+		if err != nil {
+			log.Printf("replication: failed to load metadata of %s: %v\n", cid, err)
+			continue
+		}
+
+		r.repairShards(metadata, path)
+		r.checkFile(cid, metadata)
+		r.update(func(s *ReplicationStatus) { s.Checked++ })
+	}
+
+	r.update(func(s *ReplicationStatus) {
+		s.Running = false
+		s.LastFinish = time.Now()
+		log.Printf("replication: checked %d files, %d under-replicated\n", s.Checked, s.UnderReplicated)
+	})
+}
+
+// checkFile counts the live providers holding the whole file and asks other
+// peers for copies when there are fewer than its target. Nodes hosting only
+// shards announce the file too, they don't count as copies.
+func (r *Replicator) checkFile(cid string, metadata *storage.Metadata) {
+	n := r.network
+	target := ReplicationTarget(metadata, r.cfg.Factor)
+
+	providers, err := n.FindFile(cid)
+	if err != nil {
+		log.Printf("replication: failed to find providers of %s: %v\n", cid, err)
+		return
+	}
+
+	live := []peer.ID{n.host.ID()}
+	for _, provider := range providers {
+		if provider.ID != n.host.ID() && n.isAlive(provider) && n.holdsFile(provider.ID, cid) {
+			live = append(live, provider.ID)
+		}
+	}
+
+	if len(live) >= target || RepairLeader(live) != n.host.ID() {
+		return
+	}
+
+	log.Printf("replication: %s has %d of %d copies\n", cid, len(live), target)
+	r.update(func(s *ReplicationStatus) { s.UnderReplicated++ })
+
+	holders := make(map[peer.ID]bool)
+	for _, p := range live {
+		holders[p] = true
+	}
+
+	storedSize := storage.EstimateStoredSize(metadata.Size, metadata.Shards, metadata.Pairty+metadata.Groups)
+	missing := target - len(live)
+	for _, candidate := range n.placementPeers() {
+		if missing == 0 {
+			break
+		}
+		if holders[candidate] {
+			continue
+		}
+
+		if err := n.requestReplica(candidate, cid, storedSize); err != nil {
+			log.Printf("replication: peer %s refused a copy of %s: %v\n", candidate, cid, err)
+			r.update(func(s *ReplicationStatus) { s.RepairsFailed++ })
+			continue
+		}
+
+		log.Printf("replication: asked peer %s for a copy of %s\n", candidate, cid)
+		r.update(func(s *ReplicationStatus) { s.RepairsRequested++ })
+		missing--
+	}
+
+	if missing > 0 {
+		log.Printf("replication: not enough peers to place %d more copies of %s\n", missing, cid)
+	}
+}
+
+// repairShards moves shards whose peer is gone, or that were never placed,
+// to live peers, preferring peers that hold none of the file's shards yet.
+// Shards this node lost too are regenerated from the others before moving.
+// Shards kept here on purpose, like those of replicas, stay where they are.
+func (r *Replicator) repairShards(metadata *storage.Metadata, metadataPath string) {
+	n := r.network
+	if len(metadata.Locations) != len(metadata.Parts) {
+		return
+	}
+
+	holders := make(map[string]bool)
+	for _, location := range metadata.Locations {
+		holders[location] = true
+	}
+
+	self := n.host.ID().String()
+	moved := false
+	for i, location := range metadata.Locations {
+		if location == self {
+			continue
+		}
+		if location != "" {
+			id, err := peer.Decode(location)
+			if err == nil && n.isAlive(peer.AddrInfo{ID: id}) {
+				continue
+			}
+		}
+
+		// the lost peer may have held the only copy, regenerate just that
+		// shard from the others rather than decoding the whole file
+		if _, err := os.Stat(metadata.Parts[i]); err != nil {
+			c, err := codec.For(metadata)
+			if err == nil {
+				err = c.RepairShards(metadata, []int{i})
+			}
+			if err != nil {
+				log.Printf("replication: failed to rebuild shard %s.%d: %v\n", metadata.Checksum, i, err)
+				continue
+			}
+			r.update(func(s *ReplicationStatus) { s.ShardsRebuilt++ })
+		}
+
+		candidates := n.placementPeers()
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return !holders[candidates[a].String()] && holders[candidates[b].String()]
+		})
+
+		for _, candidate := range candidates {
+			if candidate.String() == location {
+				continue
+			}
+
+			err := n.pushShard(candidate, metadata, i)
+			if err != nil {
+				log.Printf("replication: failed to move shard %s.%d to peer %s: %v\n", metadata.Checksum, i, candidate, err)
+				continue
+			}
+
+			log.Printf("replication: moved shard %s.%d to peer %s\n", metadata.Checksum, i, candidate)
+			metadata.Locations[i] = candidate.String()
+			holders[candidate.String()] = true
+			moved = true
+			r.update(func(s *ReplicationStatus) { s.ShardsMoved++ })
+			break
+		}
+	}
+
+	if moved {
+		if err := storage.SaveMetadata(metadataPath, metadata); err != nil {
+			log.Printf("replication: failed to save metadata of %s: %v\n", metadata.Checksum, err)
+		}
+	}
+}
+
+// ReplicationTarget is the number of copies metadata's file should have, the
+// file's own target or factor when the upload didn't set one.
+func ReplicationTarget(metadata *storage.Metadata, factor int) int {
+	if metadata.Replication > 0 {
+		return metadata.Replication
+	}
+	return factor
+}
+
+// RepairLeader picks the provider that repairs a file: the one with the
+// lowest ID, so nodes storing the same file don't all ask for copies at once.
+func RepairLeader(live []peer.ID) peer.ID {
+	if len(live) == 0 {
+		return ""
+	}
+	return slices.Min(live)
+}
+
+func (r *Replicator) update(apply func(s *ReplicationStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	apply(&r.status)
+}
+
+// begin marks cid as being replicated, reporting false if it already is.
+func (r *Replicator) begin(cid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inFlight[cid] {
+		return false
+	}
+	r.inFlight[cid] = true
+	return true
+}
+
+func (r *Replicator) end(cid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inFlight, cid)
+}
+
+func (n *Network) isAlive(info peer.AddrInfo) bool {
+	if n.host.Network().Connectedness(info.ID) == network.Connected {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, livenessTimeout)
+	defer cancel()
+	return n.host.Connect(ctx, info) == nil
+}
+
+// holdsFile reports whether peerID stores cid itself, which only nodes with
+// the file in their index answer with metadata for.
+func (n *Network) holdsFile(peerID peer.ID, cid string) bool {
+	ctx, cancel := context.WithTimeout(n.ctx, livenessTimeout)
+	defer cancel()
+	return n.roundTrip(ctx, peerID, Request{Type: MsgGetMetadata, CID: cid}, nil, nil) == nil
+}
+
+// requestReplica asks peerID to keep a copy of cid, which takes about size
+// bytes on disk.
+func (n *Network) requestReplica(peerID peer.ID, cid string, size int64) error {
+	ctx, cancel := context.WithTimeout(n.ctx, livenessTimeout)
+	defer cancel()
+	return n.roundTrip(ctx, peerID, Request{Type: MsgReplicate, CID: cid, Size: size}, nil, nil)
+}
+
+// replicate fetches a file another node asked this one to keep, stores it
+// like an upload without placing its shards elsewhere, and pins it. The
+// reserved bytes of capacity the request was accepted with are released once
+// it is done.
+func (n *Network) replicate(cid string, reserved int64) {
+	defer n.releaseCapacity(reserved)
+
+	r := n.replicator
+	if !r.begin(cid) {
+		return
+	}
+	defer r.end(cid)
+
+	err := n.storeReplica(cid, reserved)
+	if err != nil {
+		log.Printf("replication: failed to keep a copy of %s: %v\n", cid, err)
+		return
+	}
+
+	if err := n.fileStore.Pins().Pin(cid, storage.PinRecursive); err != nil {
+		log.Printf("replication: failed to pin %s: %v\n", cid, err)
+	}
+
+	log.Printf("replication: keeping a copy of %s\n", cid)
+	r.update(func(s *ReplicationStatus) { s.Replicated++ })
+}
+
+func (n *Network) storeReplica(cid string, reserved int64) error {
+	if _, err := n.fileStore.GetFile(cid); err == nil {
+		return nil
+	}
+
+	// raw CIDs predate chunking, storing them again would change the CID
+	if !dag.IsNode(cid) {
+		return fmt.Errorf("unsupported CID: %s", cid)
+	}
+
+	providers, err := n.FindFile(cid)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := n.fetchMetadataFrom(n.rankProviders(providers), cid)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return fmt.Errorf("no providers found for CID: %s", cid)
+	}
+
+	// the size the requester sent was only an estimate, reserve whatever
+	// the actual size needs on top of it
+	size := storage.EstimateStoredSize(metadata.Size, metadata.Shards, metadata.Pairty+metadata.Groups)
+	if extra := size - reserved; extra > 0 {
+		if err := n.reserveCapacity(extra); err != nil {
+			return err
+		}
+		defer n.releaseCapacity(extra)
+	}
+
+	// keep the copy in the codec of the original, which is Reed-Solomon for
+	// metadata that doesn't name one
+	c, err := codec.For(metadata)
+	if err != nil {
+		return err
+	}
+
+	tempDir := fmt.Sprintf("%s/%s", internalutils.TempPath, n.host.ID())
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return err
+	}
+
+	tempPath := fmt.Sprintf("%s/%s", tempDir, cid)
+	if err := n.RetrieveFile(cid, tempPath); err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	stored, err := n.storeFile(tempPath, metadata.Name, ShareOptions{
+		Replication: metadata.Replication,
+		Codec:       c.ID(),
+		Shards:      metadata.Shards,
+		Parity:      metadata.Pairty,
+		Groups:      metadata.Groups,
+		ContentType: metadata.ContentType,
+		Encryption:  metadata.Encryption,
+	}, false)
+	if err != nil {
+		return err
+	}
+	if stored != cid {
+		return fmt.Errorf("stored copy has CID %s", stored)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package networking
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"obscure-fs-rebuild/internal/config"
+
+	"github.com/ipfs/go-cid"
+)
+
+// provider records expire from the DHT, a single announcement that takes
+// longer than this is given up and retried on the next run
+const provideTimeout = time.Minute
+
+type ReproviderStatus struct {
+	Strategy   string    `json:"strategy"`
+	Running    bool      `json:"running"`
+	Total      int       `json:"total"`
+	Provided   int       `json:"provided"`
+	Failed     int       `json:"failed"`
+	LastStart  time.Time `json:"last_start"`
+	LastFinish time.Time `json:"last_finish"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+}
+
+// Reprovider re-announces the node's CIDs on a schedule so their provider
+// records never expire from the DHT.
+type Reprovider struct {
+	network *Network
+	cfg     config.ReproviderConfig
+	trigger chan struct{}
+	status  ReproviderStatus
+	mu      sync.Mutex
+}
+
+// StartReprovider announces the node's CIDs right away and then every
+// cfg.Interval until the network's context is done.
+func (n *Network) StartReprovider(cfg config.ReproviderConfig) {
+	n.reprovider = &Reprovider{
+		network: n,
+		cfg:     cfg,
+		trigger: make(chan struct{}, 1),
+		status:  ReproviderStatus{Strategy: cfg.Strategy},
+	}
+	go n.reprovider.run()
+}
+
+// ReproviderStatus reports the progress of the current or last run.
+func (n *Network) ReproviderStatus() ReproviderStatus {
+	if n.reprovider == nil {
+		return ReproviderStatus{}
+	}
+
+	n.reprovider.mu.Lock()
+	defer n.reprovider.mu.Unlock()
+	return n.reprovider.status
+}
+
+// Reprovide starts a run now instead of waiting for the next one. It reports
+// false when the reprovider isn't running or a run is already queued.
+func (n *Network) Reprovide() bool {
+	if n.reprovider == nil {
+		return false
+	}
+
+	select {
+	case n.reprovider.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Reprovider) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.network.ctx.Done():
+			return
+		case <-timer.C:
+		case <-r.trigger:
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		r.reprovide()
+
+		r.mu.Lock()
+		r.status.NextRun = time.Now().Add(r.cfg.Interval.Duration)
+		r.mu.Unlock()
+		timer.Reset(r.cfg.Interval.Duration)
+	}
+}
+
+func (r *Reprovider) reprovide() {
+	cids := r.cids()
+
+	r.mu.Lock()
+	r.status.Running = true
+	r.status.Total = len(cids)
+	r.status.Provided = 0
+	r.status.Failed = 0
+	r.status.LastStart = time.Now()
+	r.status.LastError = ""
+	r.mu.Unlock()
+
+	log.Printf("reproviding %d CIDs (strategy: %s)\n", len(cids), r.cfg.Strategy)
+
+	limiter := time.NewTicker(time.Second / time.Duration(r.cfg.RateLimit))
+	defer limiter.Stop()
+
+	for _, c := range cids {
+		select {
+		case <-r.network.ctx.Done():
+			return
+		case <-limiter.C:
+		}
+
+		ctx, cancel := context.WithTimeout(r.network.ctx, provideTimeout)
+		err := r.network.dht.Provide(ctx, c, true)
+		cancel()
+
+		r.mu.Lock()
+		if err != nil {
+			log.Printf("failed to reprovide CID: %s, error: %v\n", c, err)
+			r.status.Failed++
+			r.status.LastError = err.Error()
+		} else {
+			r.status.Provided++
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	r.status.Running = false
+	r.status.LastFinish = time.Now()
+	log.Printf("reprovided %d of %d CIDs\n", r.status.Provided, r.status.Total)
+	r.mu.Unlock()
+}
+
+// cids collects what the strategy announces. Stored files and their
+// manifests go first, so they stay discoverable even when a run is cut short.
+func (r *Reprovider) cids() []cid.Cid {
+	store := r.network.fileStore
+	seen := make(map[string]bool)
+	ordered := make([]string, 0)
+	add := func(ids []string) {
+		sort.Strings(ids)
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				ordered = append(ordered, id)
+			}
+		}
+	}
+
+	roots := make([]string, 0)
+	for id := range store.ListFiles() {
+		roots = append(roots, id)
+	}
+	add(roots)
+
+	manifests := make([]string, 0)
+	for _, id := range store.Manifests() {
+		manifests = append(manifests, id)
+	}
+	add(manifests)
+
+	if r.cfg.Strategy != "roots" {
+		pinned := make([]string, 0)
+		for id := range store.Pins().List() {
+			pinned = append(pinned, id)
+		}
+		add(pinned)
+	}
+
+	if r.cfg.Strategy == "all" {
+		add(store.HostedFiles())
+	}
+
+	cids := make([]cid.Cid, 0, len(ordered))
+	for _, id := range ordered {
+		c, err := cid.Decode(id)
+		if err != nil {
+			log.Printf("skipping invalid CID: %s\n", id)
+			continue
+		}
+		cids = append(cids, c)
+	}
+	return cids
+}
@@ -0,0 +1,333 @@
+package networking
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"obscure-fs-rebuild/internal/codec"
+	"obscure-fs-rebuild/internal/config"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ScrubIssue is a piece of data that failed to verify. Blocks are named by
+// their own CID, shards by their index within the file.
+type ScrubIssue struct {
+	CID      string `json:"cid"`
+	Kind     string `json:"kind"`
+	Block    string `json:"block,omitempty"`
+	Index    int    `json:"index,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ScrubReport struct {
+	Running  bool         `json:"running"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Files    int          `json:"files"`
+	Blocks   int          `json:"blocks"`
+	Shards   int          `json:"shards"`
+	Issues   []ScrubIssue `json:"issues"`
+}
+
+// Scrubber periodically re-hashes everything the node stores and repairs
+// what no longer matches, from parity or from peers.
+type Scrubber struct {
+	network *Network
+	cfg     config.ScrubConfig
+	trigger chan struct{}
+	report  ScrubReport
+	mu      sync.Mutex
+}
+
+// StartScrubber scrubs the store every cfg.Interval until the network's
+// context is done.
+func (n *Network) StartScrubber(cfg config.ScrubConfig) {
+	n.scrubber = &Scrubber{
+		network: n,
+		cfg:     cfg,
+		trigger: make(chan struct{}, 1),
+		report:  ScrubReport{Issues: []ScrubIssue{}},
+	}
+	go n.scrubber.run()
+}
+
+// ScrubReport returns the report of the current or last scrub.
+func (n *Network) ScrubReport() ScrubReport {
+	if n.scrubber == nil {
+		return ScrubReport{Issues: []ScrubIssue{}}
+	}
+
+	n.scrubber.mu.Lock()
+	defer n.scrubber.mu.Unlock()
+
+	report := n.scrubber.report
+	report.Issues = append([]ScrubIssue(nil), report.Issues...)
+	return report
+}
+
+// Scrub starts a scrub now. It reports false when the scrubber isn't running
+// or a scrub is already queued.
+func (n *Network) Scrub() bool {
+	if n.scrubber == nil {
+		return false
+	}
+
+	select {
+	case n.scrubber.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Scrubber) run() {
+	ticker := time.NewTicker(s.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.network.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.trigger:
+		}
+
+		s.scrub()
+	}
+}
+
+func (s *Scrubber) scrub() {
+	s.update(func(r *ScrubReport) {
+		*r = ScrubReport{Running: true, Started: time.Now(), Issues: []ScrubIssue{}}
+	})
+
+	store := s.network.fileStore
+	for cid, path := range store.ListFiles() {
+		s.scrubFile(cid, path)
+		s.update(func(r *ScrubReport) { r.Files++ })
+	}
+
+	for _, cid := range store.HostedFiles() {
+		s.scrubHosted(cid)
+	}
+
+	s.update(func(r *ScrubReport) {
+		r.Running = false
+		r.Finished = time.Now()
+		log.Printf("scrub: checked %d files, %d blocks and %d shards, found %d issues\n", r.Files, r.Blocks, r.Shards, len(r.Issues))
+	})
+}
+
+// scrubFile checks the shards of a stored file first, so damaged blocks can
+// be rebuilt from them when no peer has a copy.
+func (s *Scrubber) scrubFile(cid, metadataPath string) {
+	n := s.network
+	metadata, err := storage.LoadMetadata(metadataPath)
+	if err != nil {
+		s.record(ScrubIssue{CID: cid, Kind: "metadata", Error: err.Error()})
+		return
+	}
+
+	c, err := codec.For(metadata)
+	if err != nil {
+		s.record(ScrubIssue{CID: cid, Kind: "metadata", Error: err.Error()})
+		return
+	}
+
+	var providers []peer.ID
+	lookup := func() []peer.ID {
+		if providers == nil {
+			found, _ := n.FindFile(cid)
+			providers = n.rankProviders(found)
+		}
+		return providers
+	}
+
+	damaged, err := c.Repair(metadata)
+	s.update(func(r *ScrubReport) { r.Shards += len(metadata.Parts) })
+	if err != nil && len(damaged) > 0 {
+		// too many shards are gone for parity alone, refetch some first
+		log.Printf("scrub: unable to rebuild shards of %s from parity: %v\n", cid, err)
+		for _, i := range damaged {
+			n.fetchShardFromAny(n.ctx, metadata, i, n.shardSources(metadata, i, lookup()))
+		}
+		_, err = c.Repair(metadata)
+	}
+	for _, i := range damaged {
+		s.record(newIssue(cid, "shard", "", i, err))
+	}
+
+	if dag.IsNode(cid) {
+		s.scrubBlocks(cid, metadata, lookup)
+	}
+	s.scrubManifest(cid, metadataPath, metadata)
+}
+
+// scrubManifest rewrites a damaged manifest block from the metadata it was
+// made from.
+func (s *Scrubber) scrubManifest(cid, metadataPath string, metadata *storage.Metadata) {
+	manifest := metadata.Manifest
+	if manifest == "" {
+		return
+	}
+
+	blocks := s.network.fileStore.Blocks()
+	s.update(func(r *ScrubReport) { r.Blocks++ })
+	if err := hashing.VerifyBlock(blocks.Path(manifest), manifest); err == nil {
+		return
+	}
+
+	log.Printf("scrub: damaged manifest %s of %s\n", manifest, cid)
+	os.Remove(blocks.Path(manifest))
+	err := s.network.fileStore.PutManifest(metadata)
+	if err == nil && metadata.Manifest != manifest {
+		err = storage.SaveMetadata(metadataPath, metadata)
+	}
+	s.record(newIssue(cid, "manifest", manifest, 0, err))
+}
+
+// scrubBlocks verifies the root node and every block it links to. Damaged
+// blocks are refetched from peers, and failing that rebuilt by decoding the
+// shards and chunking the file again.
+func (s *Scrubber) scrubBlocks(root string, metadata *storage.Metadata, lookup func() []peer.ID) {
+	n := s.network
+	blocks := n.fileStore.Blocks()
+
+	damaged := make([]string, 0)
+	if err := hashing.VerifyBlock(blocks.Path(root), root); err != nil {
+		damaged = append(damaged, root)
+	} else if data, err := blocks.Get(root); err == nil {
+		node, err := dag.Decode(data)
+		if err != nil {
+			damaged = append(damaged, root)
+		} else {
+			for _, link := range node.Links {
+				if err := hashing.VerifyBlock(blocks.Path(link.CID.CID), link.CID.CID); err != nil {
+					damaged = append(damaged, link.CID.CID)
+				}
+			}
+			s.update(func(r *ScrubReport) { r.Blocks += len(node.Links) })
+		}
+	}
+	s.update(func(r *ScrubReport) { r.Blocks++ })
+
+	if len(damaged) == 0 {
+		return
+	}
+
+	missing := make([]string, 0)
+	for _, c := range damaged {
+		log.Printf("scrub: damaged block %s of %s\n", c, root)
+		os.Remove(blocks.Path(c))
+		if err := n.fetchBlockFromAny(n.ctx, c, lookup(), 0); err != nil {
+			missing = append(missing, c)
+		}
+	}
+
+	var err error
+	if len(missing) > 0 {
+		err = s.rebuildBlocks(root, metadata)
+	}
+
+	for _, c := range damaged {
+		s.record(newIssue(root, "block", c, 0, err))
+	}
+}
+
+func (s *Scrubber) rebuildBlocks(root string, metadata *storage.Metadata) error {
+	c, err := codec.For(metadata)
+	if err != nil {
+		return err
+	}
+
+	tempDir := fmt.Sprintf("%s/%s", internalutils.TempPath, s.network.host.ID())
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return err
+	}
+
+	outfile := fmt.Sprintf("%s/%s.rebuild", tempDir, root)
+	defer os.Remove(outfile)
+	err = c.Decode(metadata, outfile)
+	if err != nil {
+		return err
+	}
+
+	rebuilt, err := storeBlocks(s.network.fileStore.Blocks(), outfile)
+	if err != nil {
+		return err
+	}
+	if rebuilt != root {
+		return hashing.ErrHashMismatch
+	}
+	return nil
+}
+
+// scrubHosted verifies shards other nodes placed here against the metadata of
+// their file, refetching the damaged ones from the file's providers.
+func (s *Scrubber) scrubHosted(cid string) {
+	n := s.network
+	found, err := n.FindFile(cid)
+	if err != nil {
+		return
+	}
+
+	providers := n.rankProviders(found)
+	metadata, err := n.fetchMetadataFrom(providers, cid)
+	if err != nil || metadata == nil {
+		log.Printf("scrub: no metadata to verify hosted shards of %s\n", cid)
+		return
+	}
+
+	// fetchMetadataFrom rebuilt the paths from the CID, a provider can't
+	// point them anywhere else
+	for i, part := range metadata.Parts {
+		if _, err := os.Stat(part); err != nil {
+			continue
+		}
+
+		// without a hash there is nothing to verify the shard against
+		expected := metadata.ShardHash(i)
+		if expected == "" {
+			continue
+		}
+
+		s.update(func(r *ScrubReport) { r.Shards++ })
+		if hashing.VerifyBlock(part, expected) == nil {
+			continue
+		}
+
+		log.Printf("scrub: damaged hosted shard %s.%d\n", cid, i)
+		err = nil
+		if !n.fetchShardFromAny(n.ctx, metadata, i, n.shardSources(metadata, i, providers)) {
+			err = hashing.ErrHashMismatch
+		}
+		s.record(newIssue(cid, "shard", "", i, err))
+	}
+}
+
+func newIssue(cid, kind, block string, index int, err error) ScrubIssue {
+	issue := ScrubIssue{CID: cid, Kind: kind, Block: block, Index: index, Repaired: err == nil}
+	if err != nil {
+		issue.Error = err.Error()
+	}
+	return issue
+}
+
+func (s *Scrubber) record(issue ScrubIssue) {
+	s.update(func(r *ScrubReport) { r.Issues = append(r.Issues, issue) })
+}
+
+func (s *Scrubber) update(apply func(r *ScrubReport)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply(&s.report)
+}
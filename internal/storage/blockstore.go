@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"obscure-fs-rebuild/internal/dag"
+)
+
+// Blockstore keeps content-addressed blocks as one file per CID. Since the
+// name is the content's hash, a block that already exists is never written
+// twice. Blocks are reference-counted by the files (DAG roots) linking to
+// them; the counts are rebuilt from the roots on startup rather than stored.
+type Blockstore struct {
+	dir   string
+	mu    sync.Mutex
+	roots map[string]int64
+	refs  map[string]int
+	sizes map[string]int64
+}
+
+type BlockStats struct {
+	Files        int   `json:"files"`
+	Blocks       int   `json:"blocks"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	StoredBytes  int64 `json:"stored_bytes"`
+	SavedBytes   int64 `json:"saved_bytes"`
+
+	// filled in by FileStore.Stats, shards aren't deduplicated
+	ShardBytes int64 `json:"shard_bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+func NewBlockstore(dir string) (*Blockstore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+
+	return &Blockstore{
+		dir:   dir,
+		roots: make(map[string]int64),
+		refs:  make(map[string]int),
+		sizes: make(map[string]int64),
+	}, nil
+}
+
+func (bs *Blockstore) Path(cid string) string {
+	return fmt.Sprintf("%s/%s", bs.dir, cid)
+}
+
+func (bs *Blockstore) Has(cid string) bool {
+	_, err := os.Stat(bs.Path(cid))
+	return err == nil
+}
+
+func (bs *Blockstore) Put(cid string, data []byte) error {
+	if bs.Has(cid) {
+		return nil
+	}
+
+	// write under a temp name so a crash never leaves a truncated block
+	tmp, err := os.CreateTemp(bs.dir, filepath.Base(cid)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), bs.Path(cid))
+}
+
+func (bs *Blockstore) Get(cid string) ([]byte, error) {
+	data, err := os.ReadFile(bs.Path(cid))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("block not found for CID: %s", cid)
+	}
+	return data, err
+}
+
+// AddRef records that the file rooted at root is stored, taking a reference
+// on every distinct block it links to. Adding a root twice is a no-op, as is
+// adding a CID that isn't a DAG root.
+func (bs *Blockstore) AddRef(root string) error {
+	if !dag.IsNode(root) {
+		return nil
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if _, exists := bs.roots[root]; exists {
+		return nil
+	}
+
+	node, err := bs.node(root)
+	if err != nil {
+		return err
+	}
+
+	bs.roots[root] = node.Size
+	for cid, size := range distinctLinks(node) {
+		bs.refs[cid]++
+		bs.sizes[cid] = size
+	}
+	return nil
+}
+
+// Release drops the references taken by AddRef and deletes the root and every
+// block no other file links to, except those in keep, returning the number of
+// bytes freed.
+func (bs *Blockstore) Release(root string, keep map[string]PinType) (int64, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if _, exists := bs.roots[root]; !exists {
+		return 0, nil
+	}
+
+	node, err := bs.node(root)
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	for cid, size := range distinctLinks(node) {
+		bs.refs[cid]--
+		if bs.refs[cid] > 0 {
+			continue
+		}
+
+		delete(bs.refs, cid)
+		delete(bs.sizes, cid)
+		if _, kept := keep[cid]; kept {
+			continue
+		}
+		if err := os.Remove(bs.Path(cid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return freed, err
+		}
+		freed += size
+	}
+
+	delete(bs.roots, root)
+	if err := os.Remove(bs.Path(root)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return freed, err
+	}
+
+	return freed, nil
+}
+
+// RefCount returns how many stored files link to the block.
+func (bs *Blockstore) RefCount(cid string) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.refs[cid]
+}
+
+// Stats compares the size of all stored files with the bytes their distinct
+// blocks take up.
+func (bs *Blockstore) Stats() BlockStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	stats := BlockStats{
+		Files:  len(bs.roots),
+		Blocks: len(bs.refs),
+	}
+	for _, size := range bs.roots {
+		stats.LogicalBytes += size
+	}
+	for _, size := range bs.sizes {
+		stats.StoredBytes += size
+	}
+	stats.SavedBytes = stats.LogicalBytes - stats.StoredBytes
+
+	return stats
+}
+
+func (bs *Blockstore) node(root string) (*dag.Node, error) {
+	data, err := bs.Get(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Decode(data)
+}
+
+func distinctLinks(node *dag.Node) map[string]int64 {
+	links := make(map[string]int64, len(node.Links))
+	for _, link := range node.Links {
+		links[link.CID.CID] = link.Size
+	}
+	return links
+}
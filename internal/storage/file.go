@@ -1,6 +1,18 @@
 package storage
 
-import "os"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"obscure-fs-rebuild/internal/utils"
+
+	gocid "github.com/ipfs/go-cid"
+)
 
 type StoreMetadata struct {
 	Name string
@@ -8,22 +20,131 @@ type StoreMetadata struct {
 }
 
 type Metadata struct {
-	Name     string
-	Shards   int
-	Pairty   int
-	Checksum string
-	Parts    []string
+	Name string `json:"name"`
+
+	// length of the original file, shards are padded past it
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+
+	// codec that produced the shards, empty for files stored before codecs
+	// were pluggable, which are Reed-Solomon
+	Codec string `json:"codec,omitempty"`
+
+	Shards   int      `json:"shards"`
+	Pairty   int      `json:"pairty"`
+	Checksum string   `json:"checksum"`
+	Parts    []string `json:"parts"`
+
+	// CID of each shard's content, checked whenever a shard is read so a
+	// damaged shard is known before decoding
+	Hashes []string `json:"hashes"`
+
+	// peer ID holding each shard, empty when the shard only lives locally
+	Locations []string `json:"locations"`
+
+	// Locations as the manifest records them, where the shards were first
+	// placed. Repairs only update Locations, so the manifest keeps its CID.
+	Placement []string `json:"placement,omitempty"`
+
+	// number of nodes that should store the whole file, zero means the
+	// node's default
+	Replication int `json:"replication,omitempty"`
+
+	// local parity groups of LRC layouts, each adds one shard after the
+	// global parity
+	Groups int `json:"groups,omitempty"`
+
+	// how the file was encrypted before it was stored, empty for plaintext.
+	// The key is never stored.
+	Encryption string `json:"encryption,omitempty"`
+
+	// CID of the manifest last published for the file, see Manifest
+	Manifest string `json:"manifest,omitempty"`
 }
 
 func (m Metadata) GetShardSum() int {
-	return m.Pairty + m.Shards
+	return m.Pairty + m.Shards + m.Groups
+}
+
+// GetShardSize returns the length every shard produced by Split has. An
+// empty file still gets one byte per shard, as reedsolomon can't encode
+// empty shards.
+func (m Metadata) GetShardSize() int {
+	if m.Size == 0 {
+		return 1
+	}
+	return int((m.Size + int64(m.Shards) - 1) / int64(m.Shards))
+}
+
+// ShardHash returns the expected hash of shard i, empty when the metadata
+// predates shard hashes.
+func (m Metadata) ShardHash(i int) string {
+	if i < 0 || i >= len(m.Hashes) {
+		return ""
+	}
+	return m.Hashes[i]
+}
+
+// Localize makes metadata received from a peer safe to use on this node.
+// Shard paths are rebuilt from the CID, as the paths a peer sends could
+// point anywhere, and shards without a hash get an empty one, which is only
+// verified after decoding.
+func (m *Metadata) Localize() error {
+	if _, err := gocid.Decode(m.Checksum); err != nil {
+		return fmt.Errorf("invalid CID in metadata: %q", m.Checksum)
+	}
+	if m.Shards < 1 || m.Pairty < 0 || m.Groups < 0 || m.GetShardSum() > 256 {
+		return fmt.Errorf("invalid layout %d+%d+%d for CID: %s", m.Shards, m.Pairty, m.Groups, m.Checksum)
+	}
+
+	m.Parts = make([]string, m.GetShardSum())
+	for i := range m.Parts {
+		m.Parts[i] = ShardPath(m.Checksum, i)
+	}
+
+	if len(m.Hashes) != len(m.Parts) {
+		log.Printf("metadata for %s has no shard hashes, shards will only be verified after decoding\n", m.Checksum)
+		m.Hashes = make([]string, len(m.Parts))
+	}
+	return nil
+}
+
+func ShardPath(cid string, index int) string {
+	return fmt.Sprintf("%s/%s/%s.%d", utils.StoragePath, cid, cid, index)
+}
+
+// DetectContentType guesses a file's media type from its name, falling back
+// to sniffing the first bytes of its content.
+func DetectContentType(name string, content []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(content)
+}
+
+func MetadataPath(cid string) string {
+	return fmt.Sprintf("%s/%s/%s.meta", utils.StoragePath, cid, cid)
+}
+
+func SaveMetadata(path string, metadata *Metadata) error {
+	buf, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, buf, 0644)
 }
 
-func ReadFile(path string) ([]byte, error) {
+func LoadMetadata(path string) (*Metadata, error) {
 	buf, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return buf, nil
+	var metadata Metadata
+	if err := json.Unmarshal(buf, &metadata); err != nil {
+		return nil, fmt.Errorf("malformed metadata %s: %w", path, err)
+	}
+
+	return &metadata, nil
 }
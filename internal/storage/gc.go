@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"obscure-fs-rebuild/internal/config"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/utils"
+
+	"github.com/ipfs/go-cid"
+)
+
+type GCResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// CollectGarbage removes cached files, shards and blocks that neither the
+// index nor a pin keeps alive. Files stored through the index count as
+// recursively pinned. Anything modified within utils.GCGracePeriod is left
+// alone so uploads and transfers in progress are not cut short.
+func (fs *FileStore) CollectGarbage(tempDir string) (result GCResult, err error) {
+	fs.writes.Lock()
+	defer fs.writes.Unlock()
+
+	live := fs.mark()
+	cutoff := time.Now().Add(-utils.GCGracePeriod)
+
+	sweep := func(dir string, keep func(name string) bool) error {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if keep(entry.Name()) {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			size := DiskUsage(path)
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("gc: failed to remove %s: %v\n", path, err)
+				continue
+			}
+			result.Removed++
+			result.Freed += size
+		}
+		return nil
+	}
+
+	// blocks are kept by any pin, everything else only by a recursive one
+	err = sweep(fs.blocks.dir, func(name string) bool {
+		_, exists := live[name]
+		return exists
+	})
+	if err != nil {
+		return
+	}
+
+	// shard directories are named after their file's CID, skip anything else
+	// in the storage path such as the index and the blockstore
+	err = sweep(utils.StoragePath, func(name string) bool {
+		if _, err := cid.Decode(name); err != nil {
+			return true
+		}
+		_, exists := live[name]
+		return exists
+	})
+	if err != nil {
+		return
+	}
+
+	err = sweep(tempDir, func(name string) bool {
+		return live[name] == PinRecursive
+	})
+	return
+}
+
+// Hold keeps garbage collection from running until release is called. A
+// write holds it from its first block to its index entry, as blocks it
+// deduplicates against are only kept alive by the index once it is there.
+func (fs *FileStore) Hold() (release func()) {
+	fs.writes.RLock()
+	return fs.writes.RUnlock
+}
+
+// mark returns every CID kept alive by the index or the pin set, including
+// the manifests of indexed files. Recursive pins expand to the blocks their
+// root node links to, when the root is available locally.
+func (fs *FileStore) mark() map[string]PinType {
+	live := make(map[string]PinType)
+	for root := range fs.ListFiles() {
+		live[root] = PinRecursive
+	}
+	// a stored file's manifest lives as long as the file
+	for _, manifest := range fs.Manifests() {
+		live[manifest] = PinDirect
+	}
+	for cid, pinType := range fs.pins.List() {
+		if live[cid] != PinRecursive {
+			live[cid] = pinType
+		}
+	}
+
+	linked := make(map[string]PinType)
+	for cid, pinType := range live {
+		if pinType != PinRecursive || !dag.IsNode(cid) {
+			continue
+		}
+
+		node, err := fs.blocks.node(cid)
+		if err != nil {
+			continue
+		}
+		for link := range distinctLinks(node) {
+			linked[link] = PinDirect
+		}
+	}
+
+	for cid, pinType := range linked {
+		if _, exists := live[cid]; !exists {
+			live[cid] = pinType
+		}
+	}
+	return live
+}
+
+// RunGC collects garbage whenever disk usage crosses the configured
+// watermark, checking every cfg.GCInterval until ctx is done.
+func (fs *FileStore) RunGC(ctx context.Context, tempDir string, cfg config.StorageConfig) {
+	if cfg.Capacity <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.GCInterval.Duration)
+	defer ticker.Stop()
+
+	threshold := int64(float64(cfg.Capacity) * cfg.GCWatermark)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		usage := DiskUsage(utils.StoragePath, utils.TempPath)
+		if usage < threshold {
+			continue
+		}
+
+		log.Printf("gc: disk usage %d bytes above watermark %d, collecting\n", usage, threshold)
+		result, err := fs.CollectGarbage(tempDir)
+		if err != nil {
+			log.Printf("gc: failed: %v\n", err)
+			continue
+		}
+		log.Printf("gc: removed %d entries, freed %d bytes\n", result.Removed, result.Freed)
+	}
+}
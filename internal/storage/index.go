@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"obscure-fs-rebuild/internal/utils"
+)
+
+const (
+	opPut = "put"
+	opDel = "del"
+)
+
+type indexEntry struct {
+	Op   string `json:"op"`
+	CID  string `json:"cid"`
+	Path string `json:"path,omitempty"`
+}
+
+// Index is an append-only log of store mutations. Every write is fsynced
+// before it is acknowledged, and the log is rewritten from the live set
+// once it accumulates enough stale entries.
+type Index struct {
+	path    string
+	file    *os.File
+	entries int
+}
+
+func OpenIndex(path string) (*Index, map[string]string, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, err
+	}
+
+	files, entries, err := replayIndex(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("loaded %d entries from index: %s\n", len(files), path)
+	return &Index{path: path, file: file, entries: entries}, files, nil
+}
+
+// replayIndex rebuilds the live set from the log. A torn trailing record
+// left by a crash is cut off so that later appends start on a clean line.
+func replayIndex(path string) (map[string]string, int, error) {
+	files := make(map[string]string)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return files, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var (
+		entries int
+		offset  int64
+	)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				log.Printf("truncating torn index record at offset %d\n", offset)
+				if err := os.Truncate(path, offset); err != nil {
+					return nil, 0, err
+				}
+			}
+			break
+		}
+
+		var entry indexEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("truncating corrupt index record at offset %d\n", offset)
+			if err := os.Truncate(path, offset); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+
+		switch entry.Op {
+		case opPut:
+			files[entry.CID] = entry.Path
+		case opDel:
+			delete(files, entry.CID)
+		default:
+			log.Printf("unknown index op %q for CID: %s\n", entry.Op, entry.CID)
+		}
+
+		offset += int64(len(line))
+		entries++
+	}
+
+	return files, entries, nil
+}
+
+func (i *Index) Put(cid, path string) error {
+	return i.append(indexEntry{Op: opPut, CID: cid, Path: path})
+}
+
+func (i *Index) Delete(cid string) error {
+	return i.append(indexEntry{Op: opDel, CID: cid})
+}
+
+func (i *Index) append(entry indexEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = i.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	i.entries++
+	return nil
+}
+
+// Stale reports whether the log has grown enough past the live set to be
+// worth compacting.
+func (i *Index) Stale(live int) bool {
+	return i.entries-live > utils.IndexCompactThreshold
+}
+
+// Compact rewrites the log from the live set into a temp file and renames
+// it over the old log, so a crash mid-compaction leaves the old log intact.
+func (i *Index) Compact(files map[string]string) error {
+	tmpPath := i.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for cid, path := range files {
+		line, err := json.Marshal(indexEntry{Op: opPut, CID: cid, Path: path})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write compacted index: %w", err)
+	}
+
+	err = os.Rename(tmpPath, i.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(i.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	i.file.Close()
+	i.file = file
+	i.entries = len(files)
+
+	log.Printf("compacted index to %d entries\n", len(files))
+	return nil
+}
+
+func (i *Index) Close() error {
+	return i.file.Close()
+}
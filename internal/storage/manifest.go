@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"obscure-fs-rebuild/internal/dag"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// ManifestVersion is the manifest format written by this node. Manifests of
+// other versions are refused rather than misread.
+const ManifestVersion = 1
+
+// Manifest is the portable form of a file's metadata: everything another
+// node needs to fetch the shards and decode them, without the local paths.
+// It is stored as a JSON block of its own, so its CID is enough to find and
+// verify it. Shard locations are where the shards were first placed; they
+// are not updated when shards move, so the CID stays the same, and are only
+// tried before the providers of the file.
+type Manifest struct {
+	Version     int    `json:"version"`
+	CID         string `json:"cid"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+
+	// empty for Reed-Solomon, like Metadata.Codec
+	Codec  string `json:"codec,omitempty"`
+	Shards int    `json:"shards"`
+	Parity int    `json:"parity"`
+	Groups int    `json:"groups,omitempty"`
+
+	Replication int      `json:"replication,omitempty"`
+	Encryption  string   `json:"encryption,omitempty"`
+	Hashes      []string `json:"hashes"`
+
+	// peer ID each shard was placed on, empty for shards that weren't
+	Locations []string `json:"locations,omitempty"`
+}
+
+// NewManifest describes the file metadata was written for.
+func NewManifest(metadata *Metadata) *Manifest {
+	return &Manifest{
+		Version:     ManifestVersion,
+		CID:         metadata.Checksum,
+		Name:        metadata.Name,
+		Size:        metadata.Size,
+		ContentType: metadata.ContentType,
+		Codec:       metadata.Codec,
+		Shards:      metadata.Shards,
+		Parity:      metadata.Pairty,
+		Groups:      metadata.Groups,
+		Replication: metadata.Replication,
+		Encryption:  metadata.Encryption,
+		Hashes:      metadata.Hashes,
+		Locations:   metadata.Placement,
+	}
+}
+
+// Encode returns the manifest's block and the CID it is stored under. Equal
+// manifests always encode to the same block.
+func (m *Manifest) Encode() (cid string, data []byte, err error) {
+	data, err = json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	cid, err = dag.JSONCID(data)
+	return
+}
+
+func DecodeManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %w", err)
+	}
+
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version: %d", m.Version)
+	}
+
+	sum := m.Shards + m.Parity + m.Groups
+	if _, err := gocid.Decode(m.CID); err != nil || m.Shards < 1 || m.Parity < 0 || m.Groups < 0 || sum > 256 {
+		return nil, fmt.Errorf("invalid manifest for CID: %q", m.CID)
+	}
+	if len(m.Hashes) != 0 && len(m.Hashes) != sum {
+		return nil, fmt.Errorf("manifest for CID: %s lists %d shard hashes, want %d", m.CID, len(m.Hashes), sum)
+	}
+	if len(m.Locations) != 0 && len(m.Locations) != sum {
+		return nil, fmt.Errorf("manifest for CID: %s lists %d shard locations, want %d", m.CID, len(m.Locations), sum)
+	}
+	// the name ends up in download headers and file names, keep it one
+	if m.Name != filepath.Base(m.Name) || m.Name == "." || m.Name == ".." {
+		return nil, fmt.Errorf("invalid file name in manifest for CID: %s: %q", m.CID, m.Name)
+	}
+
+	return &m, nil
+}
+
+// Metadata returns the metadata for keeping the file's shards on this node.
+func (m *Manifest) Metadata() *Metadata {
+	metadata := &Metadata{
+		Name:        m.Name,
+		Size:        m.Size,
+		ContentType: m.ContentType,
+		Codec:       m.Codec,
+		Shards:      m.Shards,
+		Pairty:      m.Parity,
+		Groups:      m.Groups,
+		Checksum:    m.CID,
+		Replication: m.Replication,
+		Encryption:  m.Encryption,
+		Hashes:      m.Hashes,
+		Locations:   m.Locations,
+		Placement:   m.Locations,
+	}
+
+	metadata.Parts = make([]string, metadata.GetShardSum())
+	for i := range metadata.Parts {
+		metadata.Parts[i] = ShardPath(m.CID, i)
+	}
+	return metadata
+}
+
+// PutManifest stores the manifest of metadata as a block and records its
+// CID in metadata.Manifest. The first manifest of a file fixes its
+// placement to the current locations. The metadata still has to be saved.
+func (fs *FileStore) PutManifest(metadata *Metadata) error {
+	if metadata.Placement == nil {
+		metadata.Placement = slices.Clone(metadata.Locations)
+	}
+
+	cid, data, err := NewManifest(metadata).Encode()
+	if err != nil {
+		return err
+	}
+
+	if err := fs.blocks.Put(cid, data); err != nil {
+		return fmt.Errorf("failed to store manifest of %s: %w", metadata.Checksum, err)
+	}
+	metadata.Manifest = cid
+	return nil
+}
+
+// GetManifest reads a manifest from the blockstore.
+func (fs *FileStore) GetManifest(cid string) (*Manifest, error) {
+	if !dag.IsJSON(cid) {
+		return nil, fmt.Errorf("CID: %s is not a manifest", cid)
+	}
+
+	data, err := fs.blocks.Get(cid)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeManifest(data)
+}
+
+// Manifests returns the manifest CID of every stored file that has one.
+func (fs *FileStore) Manifests() map[string]string {
+	manifests := make(map[string]string)
+	for cid, path := range fs.ListFiles() {
+		metadata, err := LoadMetadata(path)
+		if err != nil || metadata.Manifest == "" {
+			continue
+		}
+		manifests[cid] = metadata.Manifest
+	}
+	return manifests
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	fileutils "obscure-fs-rebuild/utils"
+	"os"
+	"sync"
+)
+
+type PinType string
+
+const (
+	// a recursive pin keeps a file and every block it links to
+	PinRecursive PinType = "recursive"
+	// a direct pin keeps only the object itself: its root node, shards and
+	// metadata, but not the blocks it links to
+	PinDirect PinType = "direct"
+)
+
+var ErrNotPinned = errors.New("not pinned")
+
+// PinSet is the set of CIDs the garbage collector must keep. It is small, so
+// it is rewritten as a whole on every change.
+type PinSet struct {
+	path string
+	pins map[string]PinType
+	mu   sync.RWMutex
+}
+
+func OpenPinSet(path string) (*PinSet, error) {
+	ps := &PinSet{
+		path: path,
+		pins: make(map[string]PinType),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ps.pins); err != nil {
+		return nil, fmt.Errorf("malformed pin set %s: %w", path, err)
+	}
+	return ps, nil
+}
+
+// Pin adds cid to the set. A direct pin never downgrades a recursive one.
+func (ps *PinSet) Pin(cid string, pinType PinType) error {
+	if pinType != PinRecursive && pinType != PinDirect {
+		return fmt.Errorf("unknown pin type: %s", pinType)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if current, exists := ps.pins[cid]; exists && (current == pinType || current == PinRecursive) {
+		return nil
+	}
+
+	ps.pins[cid] = pinType
+	return ps.save()
+}
+
+func (ps *PinSet) Unpin(cid string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, exists := ps.pins[cid]; !exists {
+		return fmt.Errorf("%s: %w", cid, ErrNotPinned)
+	}
+
+	delete(ps.pins, cid)
+	return ps.save()
+}
+
+func (ps *PinSet) Get(cid string) (PinType, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	pinType, exists := ps.pins[cid]
+	return pinType, exists
+}
+
+func (ps *PinSet) List() map[string]PinType {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	pins := make(map[string]PinType, len(ps.pins))
+	for cid, pinType := range ps.pins {
+		pins[cid] = pinType
+	}
+	return pins
+}
+
+func (ps *PinSet) save() error {
+	data, err := json.MarshalIndent(ps.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFileAtomic(ps.path, bytes.NewReader(data), int64(len(data)))
+}
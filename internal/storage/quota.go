@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"obscure-fs-rebuild/internal/config"
+	fileutils "obscure-fs-rebuild/utils"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrUnknownKey    = errors.New("unknown API key")
+)
+
+// Quotas charges uploaded files to the API key that uploaded them. A file is
+// charged once per key no matter how often it is uploaded. Once any key is
+// configured only configured keys may upload. It also carries the node's
+// overall capacity.
+type Quotas struct {
+	path         string
+	capacity     int64
+	limits       map[string]int64
+	defaultLimit int64
+	charges      map[string]map[string]int64
+	reserved     map[string]int64
+	mu           sync.Mutex
+}
+
+type QuotaUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+func OpenQuotas(path string, cfg config.StorageConfig) (*Quotas, error) {
+	q := &Quotas{
+		path:         path,
+		capacity:     cfg.Capacity,
+		limits:       cfg.Quotas,
+		defaultLimit: cfg.DefaultQuota,
+		charges:      make(map[string]map[string]int64),
+		reserved:     make(map[string]int64),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &q.charges); err != nil {
+		return nil, fmt.Errorf("malformed quotas %s: %w", path, err)
+	}
+	return q, nil
+}
+
+func (q *Quotas) Capacity() int64 {
+	return q.capacity
+}
+
+func (q *Quotas) Usage(key string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage(key)
+}
+
+// Check fails with ErrQuotaExceeded when charging size more bytes to key
+// would take it over its limit.
+func (q *Quotas) Check(key string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.usage(key)
+	if usage.Limit > 0 && usage.Used+size > usage.Limit {
+		return fmt.Errorf("%d of %d bytes used, %d more requested: %w", usage.Used, usage.Limit, size, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// Reserve holds size bytes of key's quota for an upload in progress, so
+// concurrent uploads can't both pass the check. It fails with ErrUnknownKey
+// for keys that aren't configured and ErrQuotaExceeded when the bytes don't
+// fit. The reservation ends with Commit or Cancel.
+func (q *Quotas) Reserve(key string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, exists := q.limits[key]; len(q.limits) > 0 && !exists {
+		return ErrUnknownKey
+	}
+
+	usage := q.usage(key)
+	if usage.Limit > 0 && usage.Used+size > usage.Limit {
+		return fmt.Errorf("%d of %d bytes used, %d more requested: %w", usage.Used, usage.Limit, size, ErrQuotaExceeded)
+	}
+	q.reserved[key] += size
+	return nil
+}
+
+// Cancel drops a reservation made by Reserve.
+func (q *Quotas) Cancel(key string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.unreserve(key, size)
+}
+
+// Commit turns a reservation made by Reserve into a charge for cid.
+func (q *Quotas) Commit(key, cid string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.unreserve(key, size)
+	return q.charge(key, cid, size)
+}
+
+func (q *Quotas) Charge(key, cid string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.charge(key, cid, size)
+}
+
+func (q *Quotas) charge(key, cid string, size int64) error {
+	if _, exists := q.charges[key][cid]; exists {
+		return nil
+	}
+
+	if q.charges[key] == nil {
+		q.charges[key] = make(map[string]int64)
+	}
+	q.charges[key][cid] = size
+	return q.save()
+}
+
+// Release drops every charge for cid, once the file is gone.
+func (q *Quotas) Release(cid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changed := false
+	for key, files := range q.charges {
+		if _, exists := files[cid]; !exists {
+			continue
+		}
+
+		delete(files, cid)
+		if len(files) == 0 {
+			delete(q.charges, key)
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return q.save()
+}
+
+func (q *Quotas) unreserve(key string, size int64) {
+	q.reserved[key] -= size
+	if q.reserved[key] <= 0 {
+		delete(q.reserved, key)
+	}
+}
+
+// usage counts reservations as used, they are about to be charged.
+func (q *Quotas) usage(key string) QuotaUsage {
+	usage := QuotaUsage{Used: q.reserved[key], Limit: q.defaultLimit}
+	if limit, exists := q.limits[key]; exists {
+		usage.Limit = limit
+	}
+	for _, size := range q.charges[key] {
+		usage.Used += size
+	}
+	return usage
+}
+
+func (q *Quotas) save() error {
+	data, err := json.MarshalIndent(q.charges, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFileAtomic(q.path, bytes.NewReader(data), int64(len(data)))
+}
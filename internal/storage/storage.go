@@ -1,30 +1,160 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+
+	"obscure-fs-rebuild/internal/utils"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrPinned       = errors.New("pinned")
 )
 
 type FileStore struct {
-	files map[string]string
-	mu    sync.RWMutex
+	files  map[string]string
+	index  *Index
+	blocks *Blockstore
+	pins   *PinSet
+	mu     sync.RWMutex
+
+	// held for reading by writes in progress, for writing by garbage
+	// collection
+	writes sync.RWMutex
+
+	// capacity held by writes in progress, see ReserveCapacity
+	reserving sync.Mutex
+	reserved  atomic.Int64
 }
 
-func NewFileStore() *FileStore {
-	return &FileStore{
-		files: make(map[string]string),
-		mu:    sync.RWMutex{},
+func NewFileStore(indexPath, blocksPath, pinsPath string) (*FileStore, error) {
+	blocks, err := NewBlockstore(blocksPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := OpenPinSet(pinsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	index, files, err := OpenIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop entries whose data vanished while the node was down
+	for cid, path := range files {
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("skipping index entry %s, file missing: %s\n", cid, path)
+			delete(files, cid)
+			continue
+		}
+
+		if err := blocks.AddRef(cid); err != nil {
+			log.Printf("failed to reference blocks of %s: %v\n", cid, err)
+		}
 	}
+
+	return &FileStore{
+		files:  files,
+		index:  index,
+		blocks: blocks,
+		pins:   pins,
+		mu:     sync.RWMutex{},
+	}, nil
+}
+
+func (fs *FileStore) Blocks() *Blockstore {
+	return fs.blocks
+}
+
+func (fs *FileStore) Pins() *PinSet {
+	return fs.pins
 }
 
 func (fs *FileStore) StoreFile(cid string, path string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+
+	if err := fs.index.Put(cid, path); err != nil {
+		return fmt.Errorf("failed to persist index entry: %w", err)
+	}
 	fs.files[cid] = path
+
+	if err := fs.blocks.AddRef(cid); err != nil {
+		log.Printf("failed to reference blocks of %s: %v\n", cid, err)
+	}
+
+	if fs.index.Stale(len(fs.files)) {
+		if err := fs.index.Compact(fs.files); err != nil {
+			log.Printf("failed to compact index: %v\n", err)
+		}
+	}
 	return nil
 }
 
+// RemoveFile deletes everything the node keeps for cid: its index entry,
+// shards and metadata, and the blocks no other stored or pinned file links
+// to. Pinned content has to be unpinned first.
+func (fs *FileStore) RemoveFile(cid string) (freed int64, err error) {
+	if _, err = gocid.Decode(cid); err != nil {
+		return
+	}
+	if _, pinned := fs.pins.Get(cid); pinned {
+		return 0, fmt.Errorf("%s: %w", cid, ErrPinned)
+	}
+
+	fs.mu.Lock()
+	_, indexed := fs.files[cid]
+	if indexed {
+		if err = fs.index.Delete(cid); err != nil {
+			fs.mu.Unlock()
+			return 0, fmt.Errorf("failed to persist index entry: %w", err)
+		}
+		delete(fs.files, cid)
+
+		if fs.index.Stale(len(fs.files)) {
+			if err := fs.index.Compact(fs.files); err != nil {
+				log.Printf("failed to compact index: %v\n", err)
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	// a root that was only retrieved holds no references yet, take them so
+	// releasing it frees its unshared blocks too
+	found := indexed || fs.blocks.Has(cid)
+	if fs.blocks.AddRef(cid) == nil {
+		freed, err = fs.blocks.Release(cid, fs.mark())
+		if err != nil {
+			return
+		}
+	}
+
+	shardDir := filepath.Join(utils.StoragePath, cid)
+	if _, statErr := os.Stat(shardDir); statErr == nil {
+		found = true
+		freed += DiskUsage(shardDir)
+		if err = os.RemoveAll(shardDir); err != nil {
+			return
+		}
+	}
+
+	if !found {
+		return 0, fmt.Errorf("%s: %w", cid, ErrFileNotFound)
+	}
+	return
+}
+
 func (fs *FileStore) GetFile(cid string) (string, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
@@ -47,6 +177,12 @@ func (fs *FileStore) ListFiles() map[string]string {
 	return copy
 }
 
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.index.Close()
+}
+
 func GetFileSize(path string) (int64, error) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"obscure-fs-rebuild/internal/utils"
+
+	"github.com/ipfs/go-cid"
+)
+
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// StorageUsage breaks down the bytes a node keeps on disk. Local files were
+// uploaded to this node, hosted shards were placed here by other nodes, and
+// cached files are copies retrieved for clients.
+type StorageUsage struct {
+	Capacity int64 `json:"capacity"`
+	Used     int64 `json:"used"`
+	Local    int64 `json:"local"`
+	Hosted   int64 `json:"hosted"`
+	Cached   int64 `json:"cached"`
+	Blocks   int64 `json:"blocks"`
+}
+
+func (fs *FileStore) Usage(tempDir string) StorageUsage {
+	usage := StorageUsage{
+		Used:   DiskUsage(utils.StoragePath, utils.TempPath),
+		Cached: DiskUsage(tempDir),
+		Blocks: DiskUsage(fs.blocks.dir),
+	}
+
+	files := fs.ListFiles()
+	for _, c := range shardDirs() {
+		size := DiskUsage(filepath.Join(utils.StoragePath, c))
+		if _, exists := files[c]; exists {
+			usage.Local += size
+		} else {
+			usage.Hosted += size
+		}
+	}
+	return usage
+}
+
+// Stats reports how much the blockstore deduplicates stored files, along
+// with the bytes their shards take up. Every file keeps its own shards, so
+// they count towards the total but not towards the savings.
+func (fs *FileStore) Stats() BlockStats {
+	stats := fs.blocks.Stats()
+	for c := range fs.ListFiles() {
+		stats.ShardBytes += DiskUsage(filepath.Join(utils.StoragePath, c))
+	}
+	stats.TotalBytes = stats.StoredBytes + stats.ShardBytes
+	return stats
+}
+
+// HostedFiles returns the CIDs this node holds shards of without storing the
+// file itself, usually because other nodes placed them here.
+func (fs *FileStore) HostedFiles() []string {
+	files := fs.ListFiles()
+	hosted := make([]string, 0)
+	for _, c := range shardDirs() {
+		if _, exists := files[c]; !exists {
+			hosted = append(hosted, c)
+		}
+	}
+	return hosted
+}
+
+// shardDirs lists the directories in the storage path named after a CID.
+func shardDirs() []string {
+	entries, _ := os.ReadDir(utils.StoragePath)
+	dirs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if _, err := cid.Decode(entry.Name()); err == nil && entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs
+}
+
+// EstimateStoredSize is an upper bound on the disk space storing a file of
+// the given size takes: its blocks plus data and parity shards.
+func EstimateStoredSize(size int64, shards, parity int) int64 {
+	shardSize := (size + int64(shards) - 1) / int64(shards)
+	return size + shardSize*int64(shards+parity)
+}
+
+// ReserveCapacity holds size bytes of capacity for a write in progress, so
+// concurrent writes can't all pass the check and overrun it together.
+// Garbage is collected once before giving up. A capacity of zero is
+// unlimited. The reservation ends with ReleaseCapacity once the write
+// finished or failed.
+func (fs *FileStore) ReserveCapacity(capacity, size int64, tempDir string) error {
+	fs.reserving.Lock()
+	defer fs.reserving.Unlock()
+
+	if capacity > 0 {
+		used := DiskUsage(utils.StoragePath, utils.TempPath) + fs.reserved.Load()
+		if used+size > capacity {
+			if _, err := fs.CollectGarbage(tempDir); err != nil {
+				return err
+			}
+
+			used = DiskUsage(utils.StoragePath, utils.TempPath) + fs.reserved.Load()
+			if used+size > capacity {
+				return fmt.Errorf("%d of %d bytes used or reserved, %d more needed: %w", used, capacity, size, ErrInsufficientStorage)
+			}
+		}
+	}
+
+	fs.reserved.Add(size)
+	return nil
+}
+
+// ReleaseCapacity drops a reservation made by ReserveCapacity.
+func (fs *FileStore) ReleaseCapacity(size int64) {
+	fs.reserved.Add(-size)
+}
+
+// DiskUsage sums the sizes of all regular files below the given paths.
+func DiskUsage(paths ...string) int64 {
+	var total int64
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if size, err := GetFileSize(path); err == nil {
+				total += size
+			}
+			return nil
+		})
+	}
+	return total
+}
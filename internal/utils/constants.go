@@ -1,11 +1,45 @@
 package utils
 
+import "time"
+
 const (
 	Shards = 8
 	Pairty = 2
+
+	// local parity groups of LRC uploads that don't ask for a number
+	LocalGroups = 2
 )
 
 const (
 	StoragePath = "./uploads"
+	IndexPath   = StoragePath + "/index.log"
+	BlocksPath  = StoragePath + "/blocks"
+	PinsPath    = StoragePath + "/pins.json"
+	QuotasPath  = StoragePath + "/quotas.json"
+	TempPath    = "./temp"
+
+	// partial downloads, kept apart from the cached files served to clients
+	PartialPath = TempPath + "/partial"
+)
+
+const (
+	// compact the index log once it holds this many stale entries
+	IndexCompactThreshold = 1024
+
+	// garbage collection never touches anything modified more recently
+	GCGracePeriod = 10 * time.Minute
+
+	// partial downloads untouched for this long are not resumed but removed
+	PartialExpiry = 24 * time.Hour
+)
+
+const (
+	// content-defined chunking bounds, changing them changes every file CID
+	ChunkMinSize = 64 << 10
+	ChunkAvgSize = 256 << 10
+	ChunkMaxSize = 1 << 20
 )
 
+// erasure coding streams shards this many bytes at a time, so it needs about
+// this much memory per shard whatever the file size
+const ShardBlockSize = 256 << 10
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"obscure-fs-rebuild/internal/api"
+	"obscure-fs-rebuild/internal/config"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/networking"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+	"obscure-fs-rebuild/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestNode starts a node without peers, keeping its index, blocks and
+// pins in a temporary directory. Shards and cached files still go below the
+// working directory, so they are removed once the test is done.
+func newTestNode(t *testing.T) (*networking.Network, *storage.FileStore) {
+	dir := t.TempDir()
+	store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	network := networking.NewNetwork(ctx, 0, "", nil, store)
+	network.StartSimpleProtocol(utils.ProtocolID)
+
+	t.Cleanup(func() {
+		for cid := range store.ListFiles() {
+			os.RemoveAll(filepath.Join(internalutils.StoragePath, cid))
+		}
+		os.RemoveAll(fmt.Sprintf("%s/%s", internalutils.TempPath, network.GetHost().ID()))
+		os.RemoveAll(fmt.Sprintf("%s/%s", internalutils.PartialPath, network.GetHost().ID()))
+		network.Shutdown()
+		cancel()
+		store.Close()
+	})
+	return network, store
+}
+
+func TestGetFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	network, store := newTestNode(t)
+
+	quotas, err := storage.OpenQuotas(filepath.Join(t.TempDir(), "quotas.json"), config.StorageConfig{})
+	assert.NoError(t, err)
+	controller := api.NewNodeController(context.Background(), store, networking.NewNodeRegistry(), network, quotas)
+
+	router := gin.New()
+	router.GET("/files/:cid", controller.GetFileHandler)
+	router.HEAD("/files/:cid", controller.GetFileHandler)
+
+	content := []byte("0123456789abcdefghij")
+	path := filepath.Join(t.TempDir(), "digits.txt")
+	assert.NoError(t, os.WriteFile(path, content, 0644))
+	cid, _, err := network.ShareFile(path, networking.ShareOptions{})
+	assert.NoError(t, err)
+
+	get := func(method, cid string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/files/"+cid, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(http.MethodGet, cid, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, fmt.Sprintf("%q", cid), w.Header().Get("ETag"))
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = get(http.MethodGet, cid, map[string]string{"Range": "bytes=10-13"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "abcd", w.Body.String())
+	assert.Equal(t, fmt.Sprintf("bytes 10-13/%d", len(content)), w.Header().Get("Content-Range"))
+
+	w = get(http.MethodHead, cid, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, fmt.Sprint(len(content)), w.Header().Get("Content-Length"))
+	assert.Empty(t, w.Body.Bytes())
+
+	w = get(http.MethodGet, cid, map[string]string{"If-None-Match": fmt.Sprintf("%q", cid)})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+
+	// names of partial and scratch files next to the cached copy aren't CIDs
+	for _, name := range []string{cid + ".part", cid + ".0.part", cid + ".rebuild"} {
+		w = get(http.MethodGet, name, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, w.Header().Get("ETag"))
+	}
+
+	// a CID nobody has is neither cacheable nor "not modified"
+	builder := dag.NewBuilder(nil)
+	builder.Write([]byte("nobody has this"))
+	missing, err := builder.Finish()
+	assert.NoError(t, err)
+
+	w = get(http.MethodGet, missing, map[string]string{"If-None-Match": fmt.Sprintf("%q", missing)})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+}
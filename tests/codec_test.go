@@ -1,8 +1,13 @@
 package tests
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"obscure-fs-rebuild/internal/codec"
@@ -16,7 +21,7 @@ import (
 func TestCodec(t *testing.T) {
 	filePath := "../README.md"
 	fileName := filepath.Base(filePath)
-	buf, _ := storage.ReadFile(filePath)
+	buf, _ := os.ReadFile(filePath)
 
 	hash, _ := hashing.HashFile(filePath)
 	metadata := &storage.Metadata{
@@ -25,12 +30,12 @@ func TestCodec(t *testing.T) {
 	}
 
 	ec := codec.ErasureCodec{}
-	err := ec.Encode(metadata, buf)
+	err := ec.Encode(metadata, bytes.NewReader(buf), int64(len(buf)))
 	if err != nil {
 		panic(err)
 	}
 
-	outfile, err := ec.Decode(metadata)
+	outfile, err := decode(t, ec, metadata)
 	if err != nil {
 		panic(err)
 	}
@@ -46,3 +51,357 @@ func TestCodec(t *testing.T) {
 
 	os.RemoveAll(filepath.Dir(outfile))
 }
+
+func TestCodecRecovery(t *testing.T) {
+	filePath := "../README.md"
+	buf, _ := os.ReadFile(filePath)
+
+	hash, _ := hashing.HashFile(filePath)
+	metadata := &storage.Metadata{
+		Name:     filepath.Base(filePath),
+		Checksum: hash,
+	}
+
+	ec := codec.ErasureCodec{}
+	err := ec.Encode(metadata, bytes.NewReader(buf), int64(len(buf)))
+	assert.NoError(t, err)
+	defer os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+
+	// lose one shard
+	shard, _ := os.ReadFile(metadata.Parts[1])
+	os.Remove(metadata.Parts[1])
+
+	outfile, err := decode(t, ec, metadata)
+	assert.NoError(t, err)
+
+	hash, err = hashing.HashFile(outfile)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata.Checksum, hash)
+	assert.NoError(t, hashing.VerifyBlock(metadata.Parts[1], metadata.Hashes[1]))
+
+	// restore it and flip a byte in another
+	os.WriteFile(metadata.Parts[1], shard, 0644)
+	shard, _ = os.ReadFile(metadata.Parts[4])
+	shard[0] ^= 0xff
+	os.WriteFile(metadata.Parts[4], shard, 0644)
+
+	outfile, err = decode(t, ec, metadata)
+	assert.NoError(t, err)
+
+	hash, err = hashing.HashFile(outfile)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata.Checksum, hash)
+
+	// the corrupted shard was rewritten from parity
+	assert.NoError(t, hashing.VerifyBlock(metadata.Parts[4], metadata.Hashes[4]))
+
+	// three damaged shards are beyond two parity shards
+	for _, i := range []int{0, 3, 5} {
+		os.WriteFile(metadata.Parts[i], []byte("rot"), 0644)
+	}
+	_, err = decode(t, ec, metadata)
+	assert.Error(t, err)
+}
+
+func TestCodecRepair(t *testing.T) {
+	filePath := "../README.md"
+	buf, _ := os.ReadFile(filePath)
+
+	hash, _ := hashing.HashFile(filePath)
+	metadata := &storage.Metadata{
+		Name:     filepath.Base(filePath),
+		Checksum: hash,
+	}
+
+	ec := codec.ErasureCodec{}
+	assert.NoError(t, ec.Encode(metadata, bytes.NewReader(buf), int64(len(buf))))
+	defer os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+
+	damaged, err := ec.Repair(metadata)
+	assert.NoError(t, err)
+	assert.Empty(t, damaged)
+
+	// rot one shard and lose another
+	shard, _ := os.ReadFile(metadata.Parts[2])
+	shard[len(shard)/2] ^= 0x01
+	os.WriteFile(metadata.Parts[2], shard, 0644)
+	os.Remove(metadata.Parts[7])
+
+	damaged, err = ec.Repair(metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 7}, damaged)
+
+	for i, part := range metadata.Parts {
+		assert.NoError(t, hashing.VerifyBlock(part, metadata.Hashes[i]))
+	}
+}
+
+func TestCodecLayout(t *testing.T) {
+	buf, _ := os.ReadFile("../README.md")
+	hash, _ := hashing.HashFile("../README.md")
+	metadata := &storage.Metadata{
+		Name:     "layout",
+		Checksum: hash,
+		Shards:   4,
+		Pairty:   3,
+	}
+
+	ec := codec.ErasureCodec{}
+	assert.NoError(t, ec.Encode(metadata, bytes.NewReader(buf), int64(len(buf))))
+	defer os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+	assert.Len(t, metadata.Parts, 7)
+
+	for _, i := range []int{0, 2, 6} {
+		os.Remove(metadata.Parts[i])
+	}
+
+	outfile, err := decode(t, ec, metadata)
+	assert.NoError(t, err)
+	hash, err = hashing.HashFile(outfile)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata.Checksum, hash)
+
+	assert.Error(t, codec.Validate(codec.ReedSolomonID, 0, 2, 0))
+	assert.Error(t, codec.Validate(codec.ReedSolomonID, 200, 100, 0))
+	assert.Error(t, codec.Validate(codec.ReedSolomonID, 4, 2, 1))
+	assert.NoError(t, codec.Validate(codec.ReedSolomonID, 1, 0, 0))
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 2, 7, 8, 9, 255, 1000, 4097, 65537}
+	layouts := []struct {
+		codec                  string
+		shards, parity, groups int
+	}{
+		{codec.ReedSolomonID, 1, 0, 0},
+		{codec.ReedSolomonID, 1, 1, 0},
+		{codec.ReedSolomonID, 2, 1, 0},
+		{codec.ReedSolomonID, 3, 2, 0},
+		{codec.ReedSolomonID, 4, 3, 0},
+		{codec.ReedSolomonID, 8, 2, 0},
+		{codec.ReedSolomonID, 10, 4, 0},
+		{codec.ReedSolomonID, 17, 3, 0},
+		{codec.ReplicationID, 1, 0, 0},
+		{codec.ReplicationID, 1, 3, 0},
+		{codec.LRCID, 4, 1, 2},
+		{codec.LRCID, 5, 2, 3},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range sizes {
+		src := make([]byte, size)
+		rng.Read(src)
+
+		for _, layout := range layouts {
+			c, _ := codec.Get(layout.codec)
+			metadata := &storage.Metadata{
+				Name:     "roundtrip",
+				Checksum: fmt.Sprintf("roundtrip-%s-%d-%d-%d-%d", layout.codec, size, layout.shards, layout.parity, layout.groups),
+				Shards:   layout.shards,
+				Pairty:   layout.parity,
+				Groups:   layout.groups,
+			}
+
+			assert.NoError(t, c.Encode(metadata, bytes.NewReader(src), int64(size)), metadata.Checksum)
+			assert.Equal(t, int64(size), metadata.Size)
+
+			// losing the first shard forces the padded tail to be rebuilt
+			if layout.parity > 0 {
+				os.Remove(metadata.Parts[0])
+			}
+
+			outfile, err := decode(t, c, metadata)
+			if assert.NoError(t, err, metadata.Checksum) {
+				out, _ := os.ReadFile(outfile)
+				assert.True(t, bytes.Equal(src, out), metadata.Checksum)
+			}
+			os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+		}
+	}
+
+	assert.Equal(t, "application/json", storage.DetectContentType("data.json", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", storage.DetectContentType("notes", []byte("hello")))
+}
+
+// patternReader yields size bytes of a repeating pattern without holding them
+// in memory.
+type patternReader struct {
+	size, offset int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-r.offset {
+		p = p[:r.size-r.offset]
+	}
+	for i := range p {
+		p[i] = byte((r.offset + int64(i)) * 31 % 251)
+	}
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+func TestCodecStreaming(t *testing.T) {
+	const size = 48 << 20
+	hasher := hashing.NewHasher()
+	io.Copy(hasher, &patternReader{size: size})
+	hash, _ := hasher.CID()
+
+	metadata := &storage.Metadata{
+		Name:     "streaming",
+		Checksum: hash,
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	ec := codec.ErasureCodec{}
+	assert.NoError(t, ec.Encode(metadata, &patternReader{size: size}, size))
+	defer os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+
+	os.Remove(metadata.Parts[2])
+	outfile, err := decode(t, ec, metadata)
+	assert.NoError(t, err)
+
+	runtime.ReadMemStats(&after)
+
+	// encoding, rebuilding a shard and decoding never hold the whole file
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+
+	decoded, err := hashing.HashFile(outfile)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, decoded)
+
+	// without shard hashes a corrupted shard is found by trial
+	metadata.Hashes = nil
+	shard, _ := os.ReadFile(metadata.Parts[5])
+	shard[100] ^= 0xff
+	os.WriteFile(metadata.Parts[5], shard, 0644)
+
+	outfile, err = decode(t, ec, metadata)
+	assert.NoError(t, err)
+	decoded, err = hashing.HashFile(outfile)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, decoded)
+}
+
+func TestCodecRegistry(t *testing.T) {
+	c, err := codec.Get("")
+	assert.NoError(t, err)
+	assert.Equal(t, codec.ReedSolomonID, c.ID())
+	_, err = codec.Get("bogus")
+	assert.Error(t, err)
+
+	assert.NoError(t, codec.Validate(codec.ReplicationID, 1, 2, 0))
+	assert.Error(t, codec.Validate(codec.ReplicationID, 2, 2, 0))
+	assert.NoError(t, codec.Validate(codec.LRCID, 6, 2, 2))
+	assert.Error(t, codec.Validate(codec.LRCID, 6, 2, 0))
+	assert.Error(t, codec.Validate(codec.LRCID, 2, 2, 3))
+
+	rng := rand.New(rand.NewSource(2))
+	src := make([]byte, 100000)
+	rng.Read(src)
+
+	cases := []struct {
+		codec                  string
+		shards, parity, groups int
+		lost                   []int
+	}{
+		// any copy is enough
+		{codec.ReplicationID, 1, 2, 0, []int{0, 2}},
+		{codec.ReedSolomonID, 4, 2, 0, []int{1, 5}},
+		// one loss in each group is more than the single global parity
+		// covers, the local parities take care of it
+		{codec.LRCID, 6, 1, 2, []int{0, 4}},
+		// two losses in a group need the global parity
+		{codec.LRCID, 6, 2, 2, []int{1, 2}},
+		// a lost local parity is recomputed
+		{codec.LRCID, 6, 2, 2, []int{3, 9}},
+	}
+
+	for _, tc := range cases {
+		c, err := codec.Get(tc.codec)
+		assert.NoError(t, err)
+
+		metadata := &storage.Metadata{
+			Name:     "registry",
+			Checksum: fmt.Sprintf("registry-%s-%d-%d-%d", tc.codec, tc.shards, tc.parity, tc.groups),
+			Shards:   tc.shards,
+			Pairty:   tc.parity,
+			Groups:   tc.groups,
+		}
+		assert.NoError(t, c.Encode(metadata, bytes.NewReader(src), int64(len(src))), metadata.Checksum)
+		assert.Equal(t, tc.codec, metadata.Codec)
+		assert.Len(t, metadata.Parts, metadata.GetShardSum())
+
+		for _, i := range tc.lost {
+			os.Remove(metadata.Parts[i])
+		}
+
+		decoder, err := codec.For(metadata)
+		assert.NoError(t, err)
+		outfile, err := decode(t, decoder, metadata)
+		if assert.NoError(t, err, metadata.Checksum) {
+			out, _ := os.ReadFile(outfile)
+			assert.True(t, bytes.Equal(src, out), metadata.Checksum)
+		}
+
+		for i, part := range metadata.Parts {
+			assert.NoError(t, hashing.VerifyBlock(part, metadata.Hashes[i]), metadata.Checksum)
+		}
+		os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+	}
+}
+
+func TestCodecRepairShards(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	src := make([]byte, 70000)
+	rng.Read(src)
+
+	for _, id := range []string{codec.ReplicationID, codec.ReedSolomonID, codec.LRCID} {
+		c, _ := codec.Get(id)
+		metadata := &storage.Metadata{
+			Name:     "partial",
+			Checksum: "partial-" + id,
+		}
+		metadata.Shards, metadata.Pairty, metadata.Groups = c.Layout()
+		switch id {
+		case codec.ReplicationID:
+			metadata.Pairty = 3
+		case codec.ReedSolomonID:
+			metadata.Shards, metadata.Pairty = 6, 3
+		}
+		assert.NoError(t, c.Encode(metadata, bytes.NewReader(src), int64(len(src))))
+
+		// shard 2 is rotten but not asked for, it must not be used as a
+		// source nor be touched
+		os.Remove(metadata.Parts[1])
+		os.Remove(metadata.Parts[metadata.GetShardSum()-1])
+		shard, _ := os.ReadFile(metadata.Parts[2])
+		shard[10] ^= 0xff
+		os.WriteFile(metadata.Parts[2], shard, 0644)
+
+		assert.NoError(t, c.RepairShards(metadata, []int{1}), id)
+		assert.NoError(t, hashing.VerifyBlock(metadata.Parts[1], metadata.Hashes[1]), id)
+		assert.NoFileExists(t, metadata.Parts[metadata.GetShardSum()-1], id)
+		assert.Error(t, hashing.VerifyBlock(metadata.Parts[2], metadata.Hashes[2]), id)
+
+		// the file itself is never decoded, only the shards are there
+		entries, _ := os.ReadDir(filepath.Dir(metadata.Parts[0]))
+		assert.Len(t, entries, metadata.GetShardSum()-1, id)
+
+		assert.NoError(t, c.RepairShards(metadata, []int{2, metadata.GetShardSum() - 1}), id)
+		for i, part := range metadata.Parts {
+			assert.NoError(t, hashing.VerifyBlock(part, metadata.Hashes[i]), id)
+		}
+		os.RemoveAll(filepath.Dir(metadata.Parts[0]))
+	}
+}
+
+// decode decodes metadata's file into a temporary directory.
+func decode(t *testing.T, c codec.Codec, metadata *storage.Metadata) (string, error) {
+	outfile := filepath.Join(t.TempDir(), "decoded")
+	return outfile, c.Decode(metadata, outfile)
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"obscure-fs-rebuild/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := config.Load(filepath.Join(dir, "missing.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default(), cfg)
+
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"reprovider": {"strategy": "pinned", "interval": "1h"}}`), 0644)
+	cfg, err = config.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "pinned", cfg.Reprovider.Strategy)
+	assert.Equal(t, time.Hour, cfg.Reprovider.Interval.Duration)
+	assert.Equal(t, config.Default().Reprovider.RateLimit, cfg.Reprovider.RateLimit)
+
+	os.WriteFile(path, []byte(`{"reprovider": {"strategy": "some"}}`), 0644)
+	_, err = config.Load(path)
+	assert.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, config.Default().Validate())
+
+	for name, breakConfig := range map[string]func(c *config.Config){
+		"negative capacity":        func(c *config.Config) { c.Storage.Capacity = -1 },
+		"negative quota":           func(c *config.Config) { c.Storage.Quotas = map[string]int64{"k": -1} },
+		"gc watermark":             func(c *config.Config) { c.Storage.GCWatermark = 1.5 },
+		"reprovider strategy":      func(c *config.Config) { c.Reprovider.Strategy = "some" },
+		"reprovider rate limit":    func(c *config.Config) { c.Reprovider.RateLimit = 0 },
+		"reprovider rate too high": func(c *config.Config) { c.Reprovider.RateLimit = 2e9 },
+		"replication factor":       func(c *config.Config) { c.Replication.Factor = 0 },
+		"replication interval":     func(c *config.Config) { c.Replication.Interval.Duration = 0 },
+		"scrub interval":           func(c *config.Config) { c.Scrub.Interval.Duration = -time.Second },
+		"erasure codec":            func(c *config.Config) { c.Erasure.Codec = "" },
+		"erasure layout too wide":  func(c *config.Config) { c.Erasure.DataShards, c.Erasure.ParityShards = 200, 100 },
+	} {
+		cfg := config.Default()
+		breakConfig(cfg)
+		assert.Error(t, cfg.Validate(), name)
+	}
+}
@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"obscure-fs-rebuild/internal/dag"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildDAG(t *testing.T, data []byte, writeSize int) (string, map[string][]byte) {
+	blocks := make(map[string][]byte)
+	builder := dag.NewBuilder(func(cid string, block []byte) error {
+		blocks[cid] = append([]byte(nil), block...)
+		return nil
+	})
+
+	for len(data) > 0 {
+		n := min(writeSize, len(data))
+		builder.Write(data[:n])
+		data = data[n:]
+	}
+
+	root, err := builder.Finish()
+	assert.NoError(t, err)
+	return root, blocks
+}
+
+func TestDAGRoundTrip(t *testing.T) {
+	data := make([]byte, 5<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	root, blocks := buildDAG(t, data, 4096)
+	assert.True(t, dag.IsNode(root))
+	assert.Greater(t, len(blocks), 3)
+
+	// boundaries must not depend on how the input was buffered
+	other, _ := buildDAG(t, data, 1<<20+17)
+	assert.Equal(t, root, other)
+
+	var out bytes.Buffer
+	err := dag.Cat(root, func(cid string) ([]byte, error) {
+		block, ok := blocks[cid]
+		if !ok {
+			return nil, fmt.Errorf("missing block %s", cid)
+		}
+		return block, nil
+	}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out.Bytes())
+}
+
+func TestDAGDedupe(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	// insert a few bytes in the middle, shifting everything after it
+	edited := append(append(append([]byte(nil), data[:3<<20]...), []byte("edit")...), data[3<<20:]...)
+
+	root, blocks := buildDAG(t, data, 1<<16)
+	editedRoot, editedBlocks := buildDAG(t, edited, 1<<16)
+	assert.NotEqual(t, root, editedRoot)
+
+	shared := 0
+	for cid := range editedBlocks {
+		if _, ok := blocks[cid]; ok {
+			shared++
+		}
+	}
+
+	// only the chunk holding the edit (and the root) should differ
+	assert.GreaterOrEqual(t, shared, len(editedBlocks)-3)
+}
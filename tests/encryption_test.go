@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"obscure-fs-rebuild/internal/encryption"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, encryption.ChunkSize - 1, encryption.ChunkSize, encryption.ChunkSize + 1, 3*encryption.ChunkSize + 5} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		key, err := encryption.NewKey(encryption.Convergent, bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		var sealed bytes.Buffer
+		assert.NoError(t, encryption.Encrypt(&sealed, bytes.NewReader(data), key))
+		assert.Equal(t, encryption.CiphertextSize(int64(size)), int64(sealed.Len()), "size %d", size)
+
+		r, err := encryption.NewReader(bytes.NewReader(sealed.Bytes()), int64(sealed.Len()), key)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), r.Size())
+
+		plain, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, plain), "size %d", size)
+
+		// ranges decrypt without reading from the start
+		if size > 10 {
+			_, err := r.Seek(int64(size-10), io.SeekStart)
+			assert.NoError(t, err)
+			tail, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, data[size-10:], tail)
+		}
+	}
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	data := bytes.Repeat([]byte("obscure"), 30000)
+
+	// convergent keys encrypt equal files the same way, random keys never do
+	a, _ := encryption.NewKey(encryption.Convergent, bytes.NewReader(data))
+	b, _ := encryption.NewKey(encryption.Convergent, bytes.NewReader(data))
+	assert.Equal(t, a, b)
+
+	random, err := encryption.NewKey(encryption.Random, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, random)
+
+	_, err = encryption.NewKey("rot13", nil)
+	assert.Error(t, err)
+
+	parsed, err := encryption.ParseKey(a.String())
+	assert.NoError(t, err)
+	assert.Equal(t, a, parsed)
+	_, err = encryption.ParseKey("short")
+	assert.Error(t, err)
+
+	var sealed bytes.Buffer
+	assert.NoError(t, encryption.Encrypt(&sealed, bytes.NewReader(data), a))
+	assert.False(t, bytes.Contains(sealed.Bytes(), []byte("obscure")))
+
+	_, err = encryption.NewReader(bytes.NewReader(sealed.Bytes()), int64(sealed.Len()), random)
+	assert.ErrorIs(t, err, encryption.ErrDecrypt)
+
+	// a file cut at a chunk boundary is caught by the final chunk flag
+	cut := int64(encryption.ChunkSize + encryption.Overhead)
+	r, err := encryption.NewReader(bytes.NewReader(sealed.Bytes()[:cut]), cut, a)
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	assert.ErrorIs(t, err, encryption.ErrDecrypt)
+
+	// flipping a bit in a later chunk fails when that chunk is read
+	damaged := bytes.Clone(sealed.Bytes())
+	damaged[len(damaged)-1] ^= 1
+	r, err = encryption.NewReader(bytes.NewReader(damaged), int64(len(damaged)), a)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, encryption.ErrDecrypt)
+}
+
+func TestEncryptionWrapKey(t *testing.T) {
+	identity, err := encryption.NewIdentity()
+	assert.NoError(t, err)
+	other, err := encryption.NewIdentity()
+	assert.NoError(t, err)
+
+	recipient, err := encryption.ParseRecipient(encryption.EncodeRecipient(identity.PublicKey()))
+	assert.NoError(t, err)
+
+	key, _ := encryption.NewKey(encryption.Random, nil)
+	wrapped, err := encryption.WrapKey(key, recipient)
+	assert.NoError(t, err)
+	assert.NotContains(t, wrapped, key.String())
+
+	parsed, err := encryption.ParseIdentity(encryption.EncodeIdentity(identity))
+	assert.NoError(t, err)
+	unwrapped, err := encryption.UnwrapKey(wrapped, parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	_, err = encryption.UnwrapKey(wrapped, other)
+	assert.ErrorIs(t, err, encryption.ErrDecrypt)
+}
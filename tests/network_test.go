@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"obscure-fs-rebuild/internal/hashing"
+	"obscure-fs-rebuild/internal/networking"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+	"obscure-fs-rebuild/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectTestNodes starts two nodes, the second one connected to the first.
+func connectTestNodes(t *testing.T) (*networking.Network, *networking.Network) {
+	a, _ := newTestNode(t)
+	b, _ := newTestNode(t)
+
+	host := a.GetHost()
+	addr := fmt.Sprintf("%s/p2p/%s", host.Addrs()[0], host.ID())
+	assert.NoError(t, b.ConnectToPeer(addr))
+	return a, b
+}
+
+func shareTestFile(t *testing.T, n *networking.Network, content []byte) string {
+	path := filepath.Join(t.TempDir(), "file.bin")
+	assert.NoError(t, os.WriteFile(path, content, 0644))
+	cid, _, err := n.ShareFile(path, networking.ShareOptions{})
+	assert.NoError(t, err)
+	return cid
+}
+
+// rawRequest sends a request frame and returns the response frame and the
+// payload that follows it.
+func rawRequest(t *testing.T, from, to *networking.Network, frame []byte) (networking.Response, []byte) {
+	stream, err := from.GetHost().NewStream(context.Background(), to.GetHost().ID(), utils.ProtocolID)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	_, err = stream.Write(frame)
+	assert.NoError(t, err)
+
+	reader := bufio.NewReader(stream)
+	size, err := binary.ReadUvarint(reader)
+	assert.NoError(t, err)
+	body := make([]byte, size)
+	_, err = io.ReadFull(reader, body)
+	assert.NoError(t, err)
+
+	var resp networking.Response
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	payload, _ := io.ReadAll(reader)
+	return resp, payload
+}
+
+func encodeFrame(t *testing.T, req networking.Request) []byte {
+	body, err := json.Marshal(req)
+	assert.NoError(t, err)
+	return append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+}
+
+func TestProtocolRanges(t *testing.T) {
+	a, b := connectTestNodes(t)
+
+	content := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+	cid := shareTestFile(t, a, content)
+
+	for _, r := range []struct{ offset, length, size int64 }{
+		{0, 0, int64(len(content))},
+		{1000, 0, int64(len(content)) - 1000},
+		{1000, 500, 500},
+		{int64(len(content)) - 10, 500, 10},
+		{int64(len(content)), 0, 0},
+	} {
+		req := networking.Request{Type: networking.MsgGetFile, CID: cid, Offset: r.offset, Length: r.length}
+		resp, payload := rawRequest(t, b, a, encodeFrame(t, req))
+		assert.Equal(t, networking.StatusOK, resp.Status)
+		assert.Equal(t, r.size, resp.Size)
+		assert.Equal(t, int64(len(content)), resp.Total)
+		assert.Equal(t, content[r.offset:r.offset+r.size], payload)
+	}
+
+	req := networking.Request{Type: networking.MsgGetFile, CID: cid, Offset: int64(len(content)) + 1}
+	resp, _ := rawRequest(t, b, a, encodeFrame(t, req))
+	assert.Equal(t, networking.StatusBadRequest, resp.Status)
+
+	req = networking.Request{Type: networking.MsgGetShard, CID: "../../index.log"}
+	resp, _ = rawRequest(t, b, a, encodeFrame(t, req))
+	assert.Equal(t, networking.StatusBadRequest, resp.Status)
+
+	// frames are refused before their body is read when they claim to be
+	// larger than any request
+	resp, _ = rawRequest(t, b, a, binary.AppendUvarint(nil, 1<<30))
+	assert.Equal(t, networking.StatusBadRequest, resp.Status)
+
+	resp, _ = rawRequest(t, b, a, append(binary.AppendUvarint(nil, 4), "{bad"...))
+	assert.Equal(t, networking.StatusBadRequest, resp.Status)
+}
+
+func TestPutShard(t *testing.T) {
+	a, b := connectTestNodes(t)
+
+	cid, err := hashing.HashBytes([]byte("a file only its shards are here of"))
+	assert.NoError(t, err)
+	path := storage.ShardPath(cid, 1)
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(path)) })
+
+	put := func(shard []byte, hash string) networking.Response {
+		req := networking.Request{Type: networking.MsgPutShard, CID: cid, Index: 1, Size: int64(len(shard)), Hash: hash}
+		resp, _ := rawRequest(t, b, a, append(encodeFrame(t, req), shard...))
+		return resp
+	}
+
+	shard := []byte("the shard as it was encoded")
+	hash, err := hashing.HashBytes(shard)
+	assert.NoError(t, err)
+	other := []byte("something else entirely")
+	otherHash, err := hashing.HashBytes(other)
+	assert.NoError(t, err)
+
+	// bytes that don't match their hash are never stored
+	assert.Equal(t, networking.StatusBadRequest, put(other, hash).Status)
+	assert.NoFileExists(t, path)
+
+	assert.Equal(t, networking.StatusOK, put(shard, hash).Status)
+	assert.Equal(t, networking.StatusOK, put(shard, hash).Status)
+
+	// a shard already here isn't replaced, whatever hash comes with it
+	assert.Equal(t, networking.StatusBadRequest, put(other, otherHash).Status)
+	assert.Equal(t, networking.StatusBadRequest, put(other, "").Status)
+	stored, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, shard, stored)
+}
+
+func TestRequestFileResume(t *testing.T) {
+	a, b := connectTestNodes(t)
+
+	content := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(content)
+	cid := shareTestFile(t, a, content)
+
+	partialDir := fmt.Sprintf("%s/%s", internalutils.PartialPath, b.GetHost().ID())
+	partialPath := fmt.Sprintf("%s/%s.part", partialDir, cid)
+	assert.NoError(t, os.MkdirAll(partialDir, 0755))
+	output := filepath.Join(t.TempDir(), "out")
+
+	// a download cut short resumes from the bytes already there
+	assert.NoError(t, os.WriteFile(partialPath, content[:100<<10], 0644))
+	assert.NoError(t, b.RequestFile(a.GetHost().ID(), cid, output))
+	out, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, content, out)
+	assert.NoFileExists(t, partialPath)
+
+	// a partial that doesn't match the file fails verification once and is
+	// discarded, so the next attempt starts over
+	damaged := append([]byte(nil), content[:50<<10]...)
+	damaged[10] ^= 0xff
+	assert.NoError(t, os.WriteFile(partialPath, damaged, 0644))
+	os.Remove(output)
+
+	assert.Error(t, b.RequestFile(a.GetHost().ID(), cid, output))
+	assert.NoFileExists(t, partialPath)
+	assert.NoFileExists(t, output)
+
+	assert.NoError(t, b.RequestFile(a.GetHost().ID(), cid, output))
+	out, err = os.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, content, out)
+}
@@ -0,0 +1,28 @@
+package tests
+
+import (
+	"testing"
+
+	"obscure-fs-rebuild/internal/networking"
+	"obscure-fs-rebuild/internal/storage"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationTarget(t *testing.T) {
+	assert.Equal(t, 3, networking.ReplicationTarget(&storage.Metadata{}, 3))
+	assert.Equal(t, 5, networking.ReplicationTarget(&storage.Metadata{Replication: 5}, 3))
+	assert.Equal(t, 1, networking.ReplicationTarget(&storage.Metadata{Replication: 1}, 3))
+}
+
+func TestRepairLeader(t *testing.T) {
+	assert.Equal(t, peer.ID(""), networking.RepairLeader(nil))
+	assert.Equal(t, peer.ID("a"), networking.RepairLeader([]peer.ID{"c", "a", "b"}))
+
+	// every node picks the same leader whatever order it found providers in
+	live := []peer.ID{"QmB", "QmA", "QmC"}
+	reversed := []peer.ID{"QmC", "QmA", "QmB"}
+	assert.Equal(t, networking.RepairLeader(live), networking.RepairLeader(reversed))
+	assert.Equal(t, []peer.ID{"QmB", "QmA", "QmC"}, live)
+}
@@ -0,0 +1,416 @@
+package tests
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"obscure-fs-rebuild/internal/config"
+	"obscure-fs-rebuild/internal/dag"
+	"obscure-fs-rebuild/internal/storage"
+	internalutils "obscure-fs-rebuild/internal/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStoreIndex(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.log")
+	filePath := filepath.Join(dir, "file")
+	os.WriteFile(filePath, []byte("hello"), 0644)
+
+	store, err := storage.NewFileStore(indexPath, filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.StoreFile("cid-1", filePath))
+	assert.NoError(t, store.StoreFile("cid-2", filepath.Join(dir, "missing")))
+	store.Close()
+
+	// simulate a crash halfway through an append
+	f, _ := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"op":"put","cid":"ci`))
+	f.Close()
+
+	store, err = storage.NewFileStore(indexPath, filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	path, err := store.GetFile("cid-1")
+	assert.NoError(t, err)
+	assert.Equal(t, filePath, path)
+
+	_, err = store.GetFile("cid-2")
+	assert.Error(t, err)
+
+	assert.NoError(t, store.StoreFile("cid-3", filePath))
+	assert.Len(t, store.ListFiles(), 2)
+}
+
+func TestBlockstoreRefCount(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	edited := append(append([]byte(nil), data...), []byte("tail")...)
+
+	blocks := store.Blocks()
+	var roots []string
+	for _, content := range [][]byte{data, edited} {
+		builder := dag.NewBuilder(blocks.Put)
+		builder.Write(content)
+		root, err := builder.Finish()
+		assert.NoError(t, err)
+		assert.NoError(t, store.StoreFile(root, filepath.Join(dir, "index.log")))
+		roots = append(roots, root)
+	}
+
+	stats := blocks.Stats()
+	assert.Equal(t, 2, stats.Files)
+	assert.Equal(t, int64(len(data)+len(edited)), stats.LogicalBytes)
+	assert.Greater(t, stats.SavedBytes, int64(len(data)/2))
+
+	// shards come on top of the deduplicated blocks
+	shard := storage.ShardPath(roots[1], 0)
+	os.MkdirAll(filepath.Dir(shard), 0755)
+	defer os.RemoveAll(filepath.Dir(shard))
+	os.WriteFile(shard, make([]byte, 100), 0644)
+
+	stats = store.Stats()
+	assert.Equal(t, int64(100), stats.ShardBytes)
+	assert.Equal(t, stats.StoredBytes+100, stats.TotalBytes)
+
+	// blocks shared with the edited copy must survive releasing the original
+	_, err = blocks.Release(roots[0], nil)
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.NoError(t, dag.Cat(roots[1], blocks.Get, &out))
+	assert.Equal(t, edited, out.Bytes())
+}
+
+func TestGarbageCollection(t *testing.T) {
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "temp")
+	os.MkdirAll(tempDir, 0755)
+
+	store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	blocks := store.Blocks()
+	build := func(seed int64) string {
+		data := make([]byte, 1<<20)
+		rand.New(rand.NewSource(seed)).Read(data)
+		builder := dag.NewBuilder(blocks.Put)
+		builder.Write(data)
+		root, err := builder.Finish()
+		assert.NoError(t, err)
+		return root
+	}
+
+	stored, pinned, direct, garbage := build(4), build(5), build(6), build(7)
+	assert.NoError(t, store.StoreFile(stored, filepath.Join(dir, "pins.json")))
+	assert.NoError(t, store.Pins().Pin(pinned, storage.PinRecursive))
+	assert.NoError(t, store.Pins().Pin(direct, storage.PinDirect))
+	for _, cid := range []string{pinned, garbage} {
+		os.WriteFile(filepath.Join(tempDir, cid), []byte("cached"), 0644)
+	}
+
+	// collection skips anything recent, so age everything first
+	old := time.Now().Add(-time.Hour)
+	for _, d := range []string{blocks.Path(""), tempDir} {
+		entries, _ := os.ReadDir(d)
+		for _, entry := range entries {
+			os.Chtimes(filepath.Join(d, entry.Name()), old, old)
+		}
+	}
+
+	result, err := store.CollectGarbage(tempDir)
+	assert.NoError(t, err)
+	assert.Greater(t, result.Removed, 0)
+
+	assert.True(t, blocks.Has(stored))
+	assert.True(t, blocks.Has(pinned))
+	assert.True(t, blocks.Has(direct))
+	assert.False(t, blocks.Has(garbage))
+
+	var out bytes.Buffer
+	assert.NoError(t, dag.Cat(pinned, blocks.Get, &out))
+	assert.Error(t, dag.Cat(direct, blocks.Get, &out))
+
+	_, err = os.Stat(filepath.Join(tempDir, pinned))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(tempDir, garbage))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.ErrorIs(t, store.Pins().Unpin(garbage), storage.ErrNotPinned)
+
+	// a write deduplicating against unreferenced blocks keeps them until it
+	// is indexed
+	orphan := build(8)
+	entries, _ := os.ReadDir(blocks.Path(""))
+	for _, entry := range entries {
+		os.Chtimes(filepath.Join(blocks.Path(""), entry.Name()), old, old)
+	}
+
+	release := store.Hold()
+	collected := make(chan struct{})
+	go func() {
+		store.CollectGarbage(tempDir)
+		close(collected)
+	}()
+
+	assert.Equal(t, orphan, build(8))
+	select {
+	case <-collected:
+		t.Fatal("garbage collected during a write")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, store.StoreFile(orphan, filepath.Join(dir, "pins.json")))
+	release()
+	<-collected
+
+	out.Reset()
+	assert.NoError(t, dag.Cat(orphan, blocks.Get, &out))
+}
+
+func TestQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	cfg := config.StorageConfig{Quotas: map[string]int64{"alice": 100}, DefaultQuota: 10}
+
+	quotas, err := storage.OpenQuotas(path, cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, quotas.Check("alice", 100))
+	assert.ErrorIs(t, quotas.Check("bob", 11), storage.ErrQuotaExceeded)
+
+	assert.NoError(t, quotas.Charge("alice", "cid-1", 60))
+	assert.NoError(t, quotas.Charge("alice", "cid-1", 60))
+	assert.ErrorIs(t, quotas.Check("alice", 41), storage.ErrQuotaExceeded)
+
+	// charges survive a restart
+	quotas, err = storage.OpenQuotas(path, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.QuotaUsage{Used: 60, Limit: 100}, quotas.Usage("alice"))
+
+	assert.NoError(t, quotas.Release("cid-1"))
+	assert.Equal(t, int64(0), quotas.Usage("alice").Used)
+
+	// reservations hold the quota until they are charged or cancelled
+	assert.NoError(t, quotas.Reserve("alice", 70))
+	assert.ErrorIs(t, quotas.Reserve("alice", 40), storage.ErrQuotaExceeded)
+	assert.NoError(t, quotas.Commit("alice", "cid-2", 70))
+	assert.Equal(t, storage.QuotaUsage{Used: 70, Limit: 100}, quotas.Usage("alice"))
+	assert.NoError(t, quotas.Reserve("alice", 30))
+	quotas.Cancel("alice", 30)
+	assert.Equal(t, int64(70), quotas.Usage("alice").Used)
+
+	// once keys are configured, others can't upload at all
+	assert.ErrorIs(t, quotas.Reserve("bob", 1), storage.ErrUnknownKey)
+	assert.ErrorIs(t, quotas.Reserve("", 1), storage.ErrUnknownKey)
+
+	open, err := storage.OpenQuotas(filepath.Join(t.TempDir(), "quotas.json"), config.StorageConfig{DefaultQuota: 10})
+	assert.NoError(t, err)
+	assert.NoError(t, open.Reserve("", 10))
+	assert.ErrorIs(t, open.Reserve("anyone", 11), storage.ErrQuotaExceeded)
+}
+
+func TestReserveCapacity(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	// reservations hold the capacity until they are released, so writes in
+	// progress can't overrun it together
+	capacity := storage.DiskUsage(internalutils.StoragePath, internalutils.TempPath) + 100
+	assert.NoError(t, store.ReserveCapacity(capacity, 60, dir))
+	assert.ErrorIs(t, store.ReserveCapacity(capacity, 60, dir), storage.ErrInsufficientStorage)
+	assert.NoError(t, store.ReserveCapacity(capacity, 40, dir))
+
+	store.ReleaseCapacity(60)
+	assert.NoError(t, store.ReserveCapacity(capacity, 60, dir))
+
+	// without a limit nothing is refused, but the bytes are still held
+	assert.NoError(t, store.ReserveCapacity(0, 1<<40, dir))
+	assert.ErrorIs(t, store.ReserveCapacity(capacity, 1, dir), storage.ErrInsufficientStorage)
+}
+
+func TestRemoveFile(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage.FileStore {
+		store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+		assert.NoError(t, err)
+		return store
+	}
+
+	store := open()
+	blocks := store.Blocks()
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(8)).Read(data)
+
+	var roots []string
+	for _, content := range [][]byte{data, append(append([]byte(nil), data...), 'x')} {
+		builder := dag.NewBuilder(blocks.Put)
+		builder.Write(content)
+		root, err := builder.Finish()
+		assert.NoError(t, err)
+		assert.NoError(t, store.StoreFile(root, filepath.Join(dir, "index.log")))
+		roots = append(roots, root)
+	}
+
+	assert.NoError(t, store.Pins().Pin(roots[0], storage.PinRecursive))
+	_, err := store.RemoveFile(roots[0])
+	assert.ErrorIs(t, err, storage.ErrPinned)
+
+	assert.NoError(t, store.Pins().Unpin(roots[0]))
+	freed, err := store.RemoveFile(roots[0])
+	assert.NoError(t, err)
+	assert.Less(t, freed, int64(len(data)))
+	assert.False(t, blocks.Has(roots[0]))
+
+	_, err = store.RemoveFile(roots[0])
+	assert.ErrorIs(t, err, storage.ErrFileNotFound)
+	store.Close()
+
+	// the removal is persisted and the other file is still intact
+	store = open()
+	defer store.Close()
+	_, err = store.GetFile(roots[0])
+	assert.Error(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, dag.Cat(roots[1], store.Blocks().Get, &out))
+	assert.Equal(t, len(data)+1, out.Len())
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "temp")
+	os.MkdirAll(tempDir, 0755)
+
+	store, err := storage.NewFileStore(filepath.Join(dir, "index.log"), filepath.Join(dir, "blocks"), filepath.Join(dir, "pins.json"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	blocks := store.Blocks()
+	builder := dag.NewBuilder(blocks.Put)
+	builder.Write([]byte("manifest test"))
+	root, err := builder.Finish()
+	assert.NoError(t, err)
+
+	metadata := &storage.Metadata{
+		Name:        "notes.txt",
+		Size:        13,
+		ContentType: "text/plain; charset=utf-8",
+		Codec:       "lrc",
+		Shards:      4,
+		Pairty:      1,
+		Groups:      2,
+		Checksum:    root,
+		Hashes:      []string{"h0", "h1", "h2", "h3", "h4", "h5", "h6"},
+		Locations:   []string{"", "p1", "p2", "", "p4", "p5", ""},
+	}
+	assert.NoError(t, store.PutManifest(metadata))
+	assert.Equal(t, metadata.Locations, metadata.Placement)
+	assert.True(t, dag.IsJSON(metadata.Manifest))
+	assert.False(t, dag.IsNode(metadata.Manifest))
+
+	metadataPath := filepath.Join(dir, "notes.meta")
+	assert.NoError(t, storage.SaveMetadata(metadataPath, metadata))
+	assert.NoError(t, store.StoreFile(root, metadataPath))
+
+	// the manifest is addressed by its content
+	manifest, err := store.GetManifest(metadata.Manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.NewManifest(metadata), manifest)
+
+	cid, _, err := manifest.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, metadata.Manifest, cid)
+
+	assert.Equal(t, metadata.Locations, manifest.Locations)
+
+	// moving a shard keeps the manifest, and the placement it records
+	metadata.Locations = []string{"p0", "p1", "p2", "", "p4", "p5", ""}
+	assert.NoError(t, store.PutManifest(metadata))
+	assert.Equal(t, cid, metadata.Manifest)
+	assert.Equal(t, "", metadata.Placement[0])
+
+	// everything but the local paths and later moves survives the trip
+	restored := manifest.Metadata()
+	assert.Equal(t, storage.ShardPath(root, 6), restored.Parts[6])
+	assert.Equal(t, metadata.Placement, restored.Locations)
+	restored.Parts, metadata.Parts = nil, nil
+	metadata.Manifest, metadata.Locations = "", metadata.Placement
+	assert.Equal(t, metadata, restored)
+
+	for _, data := range []string{
+		`{"version":2,"cid":"` + root + `","shards":4}`,
+		`{"version":1,"cid":"` + root + `","shards":4,"parity":2,"hashes":["h0"]}`,
+		`{"version":1,"cid":"` + root + `","shards":4,"parity":2,"locations":["p0"]}`,
+		`{"version":1,"cid":"not a cid","shards":4}`,
+		`{"version":1,"cid":"` + root + `","shards":200,"parity":100}`,
+		`{"version":1,"cid":"` + root + `","name":"../../index.log","shards":4}`,
+		`{"version":1,"cid":"` + root + `","name":"/etc/passwd","shards":4}`,
+		`{"version":1,"cid":"` + root + `","name":"..","shards":4}`,
+	} {
+		_, err := storage.DecodeManifest([]byte(data))
+		assert.Error(t, err, data)
+	}
+
+	// stored files keep their manifest, others are collected
+	manifest.Name = "renamed.txt"
+	orphan, data, err := manifest.Encode()
+	assert.NoError(t, err)
+	assert.NoError(t, blocks.Put(orphan, data))
+
+	old := time.Now().Add(-time.Hour)
+	entries, _ := os.ReadDir(blocks.Path(""))
+	for _, entry := range entries {
+		os.Chtimes(filepath.Join(blocks.Path(""), entry.Name()), old, old)
+	}
+
+	_, err = store.CollectGarbage(tempDir)
+	assert.NoError(t, err)
+	assert.True(t, blocks.Has(cid))
+	assert.False(t, blocks.Has(orphan))
+	assert.Equal(t, map[string]string{root: cid}, store.Manifests())
+}
+
+func TestLocalizeMetadata(t *testing.T) {
+	builder := dag.NewBuilder(func(string, []byte) error { return nil })
+	builder.Write([]byte("localize test"))
+	root, err := builder.Finish()
+	assert.NoError(t, err)
+
+	// metadata as a hostile peer could send it
+	metadata := &storage.Metadata{
+		Name:     "notes.txt",
+		Shards:   2,
+		Pairty:   1,
+		Checksum: root,
+		Parts:    []string{"../../../etc/passwd", "/tmp/x"},
+		Hashes:   []string{"h0"},
+	}
+	assert.NoError(t, metadata.Localize())
+	assert.Len(t, metadata.Parts, 3)
+	for i, part := range metadata.Parts {
+		assert.Equal(t, storage.ShardPath(root, i), part)
+	}
+
+	// shards without a hash are left unverified rather than indexed past
+	assert.Equal(t, []string{"", "", ""}, metadata.Hashes)
+	assert.Equal(t, "", metadata.ShardHash(5))
+
+	metadata = &storage.Metadata{Shards: 2, Pairty: 1, Checksum: root, Hashes: []string{"h0", "h1", "h2"}}
+	assert.NoError(t, metadata.Localize())
+	assert.Equal(t, "h2", metadata.ShardHash(2))
+
+	assert.Error(t, (&storage.Metadata{Shards: 2, Checksum: "../x"}).Localize())
+	assert.Error(t, (&storage.Metadata{Shards: 0, Checksum: root}).Localize())
+	assert.Error(t, (&storage.Metadata{Shards: 200, Pairty: 100, Checksum: root}).Localize())
+}
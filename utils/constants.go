@@ -2,4 +2,4 @@ package utils
 
 import "github.com/libp2p/go-libp2p/core/protocol"
 
-const ProtocolID = protocol.ID("oscure-fs/1.0.0")
+const ProtocolID = protocol.ID("oscure-fs/2.0.0")
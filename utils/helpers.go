@@ -3,6 +3,7 @@ package utils
 import (
 	"io"
 	"os"
+	"path/filepath"
 )
 
 func CopyFile(sourcePath, destPath string) error {
@@ -12,22 +13,62 @@ func CopyFile(sourcePath, destPath string) error {
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(destPath)
+	return WriteFileAtomic(destPath, sourceFile, -1)
+}
+
+// WriteFileAtomic streams size bytes from r into a temp file next to destPath
+// and renames it into place once everything is on disk, so readers never see
+// a partially written file. A negative size copies until EOF.
+func WriteFileAtomic(destPath string, r io.Reader, size int64) error {
+	return WriteFileVerified(destPath, r, size, nil)
+}
+
+// WriteFileVerified behaves like WriteFileAtomic but only renames the file
+// into place when verify, called after the copy, returns nil.
+func WriteFileVerified(destPath string, r io.Reader, size int64, verify func() error) (err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if size < 0 {
+		_, err = io.Copy(tmpFile, r)
+	} else {
+		_, err = io.CopyN(tmpFile, r, size)
+	}
 	if err != nil {
 		return err
 	}
 
+	if verify != nil {
+		err = verify()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Sync to ensure data is written to disk
-	err = destFile.Sync()
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Chmod(0644)
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(tmpFile.Name(), destPath)
 }